@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type CareerStats struct {
+	SteamID       uint64                     `json:"steam_id"`
+	Nickname      string                     `json:"nickname"` // Nickname in the latest match
+	Aliases       []string                   `json:"aliases"`  // Every in-game name used
+	MatchesPlayed int                        `json:"matches_played"`
+	Wins          int                        `json:"wins"`
+	Losses        int                        `json:"losses"`
+	Draws         int                        `json:"draws"`
+	WinRate       float64                    `json:"win_rate"`
+	Rounds        int                        `json:"rounds"`
+	ADR           float64                    `json:"adr"`
+	Kast          float64                    `json:"kast"`
+	Rating        float64                    `json:"rating"`
+	Totals        PlayerScore                `json:"totals"`
+	Maps          map[string]*CareerMapStats `json:"maps"`
+
+	kastRounds   float64 // KAST and rating are weighted by rounds
+	ratingRounds float64
+}
+
+type CareerMapStats struct {
+	MatchesPlayed int     `json:"matches_played"`
+	Wins          int     `json:"wins"`
+	WinRate       float64 `json:"win_rate"`
+	Rounds        int     `json:"rounds"`
+	Kills         int     `json:"kills"`
+	Deaths        int     `json:"deaths"`
+	DamageDone    int     `json:"damage_done"`
+	ADR           float64 `json:"adr"`
+	Kast          float64 `json:"kast"`
+	Rating        float64 `json:"rating"`
+
+	kastRounds   float64
+	ratingRounds float64
+}
+
+type scoreboardFilter struct {
+	mapName string
+	player  uint64
+	files   string
+}
+
+func (f scoreboardFilter) matches(sb ParsedScoreboard) bool {
+	if f.mapName != "" && sb.MapName != f.mapName {
+		return false
+	}
+	if f.player != 0 && sb.getPlayer(f.player) == nil {
+		return false
+	}
+	if f.files != "" && !strings.Contains(sb.File, f.files) {
+		return false
+	}
+	return true
+}
+
+func aggregateCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	out := fs.String("out", "data/aggregate.json", "json file for the career stats")
+	mapName := fs.String("map", "", "only matches on this map")
+	player := fs.Uint64("player", 0, "only matches with this player (SteamID64)")
+	files := fs.String("files", "", "only scoreboard files whose name contains this")
+	fs.Parse(args)
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	filter := scoreboardFilter{mapName: *mapName, player: *player, files: *files}
+
+	var selected []ParsedScoreboard
+	for _, sb := range scoreboards {
+		if filter.matches(sb) {
+			selected = append(selected, sb)
+		}
+	}
+
+	careers := aggregateCareers(selected)
+
+	data, err := json.MarshalIndent(careers, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	printCareers(careers)
+	slog.Info(fmt.Sprintf("Aggregated %v matches into %v", len(selected), *out))
+
+	return nil
+}
+
+// Match result for the player: 1 win, 0 draw, -1 loss
+func matchResult(sb Scoreboard, ps PlayerScore) int {
+	opponentRounds := sb.RoundsPlayed - ps.TeamRounds
+	switch {
+	case ps.TeamRounds > opponentRounds:
+		return 1
+	case ps.TeamRounds < opponentRounds:
+		return -1
+	}
+	return 0
+}
+
+func aggregateCareers(scoreboards []ParsedScoreboard) []*CareerStats {
+	careers := make(map[uint64]*CareerStats)
+
+	// By date so the nickname is from the latest match
+	scoreboards = slices.Clone(scoreboards)
+	sort.SliceStable(scoreboards, func(i, j int) bool { return scoreboards[i].date().Before(scoreboards[j].date()) })
+
+	for _, sb := range scoreboards {
+		rounds := float64(sb.RoundsPlayed)
+
+		for _, ps := range sb.PlayerScores {
+			c, ok := careers[ps.SteamID]
+			if !ok {
+				c = &CareerStats{SteamID: ps.SteamID, Maps: make(map[string]*CareerMapStats)}
+				careers[ps.SteamID] = c
+			}
+
+			c.Nickname = ps.Nickname
+			for _, alias := range ps.Aliases {
+				if !slices.Contains(c.Aliases, alias) {
+					c.Aliases = append(c.Aliases, alias)
+				}
+			}
+			c.MatchesPlayed += 1
+			c.Rounds += sb.RoundsPlayed
+			c.kastRounds += ps.Kast * rounds
+			c.ratingRounds += ps.Rating * rounds
+			addCounters(&c.Totals, ps)
+
+			m, ok := c.Maps[sb.MapName]
+			if !ok {
+				m = &CareerMapStats{}
+				c.Maps[sb.MapName] = m
+			}
+
+			m.MatchesPlayed += 1
+			m.Rounds += sb.RoundsPlayed
+			m.Kills += ps.Kills
+			m.Deaths += ps.Deaths
+			m.DamageDone += ps.DamageDone
+			m.kastRounds += ps.Kast * rounds
+			m.ratingRounds += ps.Rating * rounds
+
+			switch matchResult(sb.Scoreboard, ps) {
+			case 1:
+				c.Wins += 1
+				m.Wins += 1
+			case -1:
+				c.Losses += 1
+			default:
+				c.Draws += 1
+			}
+		}
+	}
+
+	var result []*CareerStats
+	for _, c := range careers {
+		c.WinRate = float64(c.Wins) / float64(c.MatchesPlayed)
+
+		if c.Rounds > 0 {
+			c.ADR = float64(c.Totals.DamageDone) / float64(c.Rounds)
+			c.Kast = c.kastRounds / float64(c.Rounds)
+			c.Rating = c.ratingRounds / float64(c.Rounds)
+		}
+
+		// Totals hold summed counters, derived values are replaced with the career values
+		c.Totals.SteamID = c.SteamID
+		c.Totals.Nickname = c.Nickname
+		c.Totals.Aliases = c.Aliases
+		c.Totals.ADR = c.ADR
+		c.Totals.Kast = c.Kast
+		c.Totals.Rating = c.Rating
+		c.Totals.PlayedRounds = c.Rounds
+		c.Totals.calculateAverageSpeed()
+
+		for _, m := range c.Maps {
+			m.WinRate = float64(m.Wins) / float64(m.MatchesPlayed)
+			if m.Rounds > 0 {
+				m.ADR = float64(m.DamageDone) / float64(m.Rounds)
+				m.Kast = m.kastRounds / float64(m.Rounds)
+				m.Rating = m.ratingRounds / float64(m.Rounds)
+			}
+		}
+
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MatchesPlayed != result[j].MatchesPlayed {
+			return result[i].MatchesPlayed > result[j].MatchesPlayed
+		}
+		return result[i].SteamID < result[j].SteamID
+	})
+
+	return result
+}
+
+// Counters summed over matches, by json name. Maps are summed key by key
+var summedCounters = []string{
+	"kills", "assists", "deaths", "damage_done", "damage_received", "team_damage_done", "team_damage_received",
+	"mvps", "money_spent_total", "kills_by_weapon", "kills_by_type", "deaths_by_weapon", "deaths_by_type", "chicken_kills",
+	"played_rounds",
+	"he_damage_dealt", "he_damage_received", "team_he_damage_dealt", "team_he_damage_received", "he_self_damage", "hes_thrown",
+	"burn_damage_dealt", "burn_damage_received", "team_burn_damage_dealt", "team_burn_damage_received", "burn_self_damage", "burns_thrown",
+	"enemies_full_flashed", "full_flashes_received", "team_full_flashes", "team_full_flashes_received", "self_full_flashes",
+	"enemies_half_flashed", "half_flashes_received", "team_half_flashes", "team_half_flashes_received", "self_half_flashes",
+	"flashes_thrown", "smokes_thrown", "decoys_thrown",
+	"headshot_kills", "headshot_deaths", "team_headshot_kills", "team_headshot_deaths",
+	"smoke_kills", "smoke_deaths", "team_smoke_kills", "team_smoke_deaths",
+	"blind_kills", "blind_deaths", "team_blind_kills", "team_blind_deaths",
+	"flash_assists", "flash_kills", "flash_deaths", "team_flash_assists", "team_flash_kills", "team_flash_deaths",
+	"no_scope_kills", "no_scope_deaths", "team_no_scope_kills", "team_no_scope_deaths",
+	"wallbang_kills", "wallbang_deaths", "team_wallbang_kills", "team_wallbang_deaths",
+	"suicides", "reloads", "shots_fired", "shots_on_enemies", "shots_on_teammates",
+	"enemy_2k", "enemy_3k", "enemy_4k", "enemy_5k", "entry_count", "entry_wins",
+	"clutch_v1_count", "clutch_v1_wins", "clutch_v2_count", "clutch_v2_wins", "clutch_v3_count", "clutch_v3_wins",
+	"clutch_v4_count", "clutch_v4_wins", "clutch_v5_count", "clutch_v5_wins", "clutch_losses", "clutch_saves",
+	"kniferound_kills", "kniferound_assists", "kniferound_deaths",
+	"distance_travelled", "time_alive", "time_crouched", "time_airborne", "shots_while_moving", "shots_while_still",
+	"OnDeathDroppedUtilityValue", "OnDeathDroppedBoughtUtilityValue",
+}
+
+// Fields that aren't summed over matches. Team fields only make sense within a match, distances by round are per
+// match rounds, max speed is kept as a maximum, timings are merged by their sample counts and the derived values
+// are calculated from the career totals
+var notSummedCounters = []string{"team_id", "team_rounds", "distance_by_round", "max_speed", "timings_by_weapon_class", "adr", "kast", "rating", "average_speed"}
+
+func addCounters(total *PlayerScore, ps PlayerScore) {
+	tv := reflect.ValueOf(total).Elem()
+	pv := reflect.ValueOf(ps)
+
+	for i := 0; i < tv.NumField(); i++ {
+		field := tv.Type().Field(i)
+		if !field.IsExported() || !slices.Contains(summedCounters, counterName(field)) {
+			continue
+		}
+
+		f, v := tv.Field(i), pv.Field(i)
+
+		switch f.Kind() {
+		case reflect.Int:
+			f.SetInt(f.Int() + v.Int())
+		case reflect.Float64:
+			f.SetFloat(f.Float() + v.Float())
+		case reflect.Map:
+			elemKind := f.Type().Elem().Kind()
+			if v.IsNil() || (elemKind != reflect.Int && elemKind != reflect.Float64) {
+				continue
+			}
+			if f.IsNil() {
+				f.Set(reflect.MakeMap(f.Type()))
+			}
+
+			iter := v.MapRange()
+			for iter.Next() {
+				current := f.MapIndex(iter.Key())
+				sum := reflect.New(f.Type().Elem()).Elem()
+				if elemKind == reflect.Int {
+					sum.SetInt(iter.Value().Int())
+					if current.IsValid() {
+						sum.SetInt(sum.Int() + current.Int())
+					}
+				} else {
+					sum.SetFloat(iter.Value().Float())
+					if current.IsValid() {
+						sum.SetFloat(sum.Float() + current.Float())
+					}
+				}
+				f.SetMapIndex(iter.Key(), sum)
+			}
+		}
+	}
+
+	total.MaxSpeed = max(total.MaxSpeed, ps.MaxSpeed)
+	addTimings(total, ps)
+}
+
+func addTimings(total *PlayerScore, ps PlayerScore) {
+	total.Timings = mergeTimings(total.Timings, ps.Timings)
+
+	if total.TimingsByWeaponClass == nil {
+		total.TimingsByWeaponClass = make(map[string]*TimingStats)
+	}
+	for class, t := range ps.TimingsByWeaponClass {
+		merged := *t
+		if current := total.TimingsByWeaponClass[class]; current != nil {
+			merged = mergeTimings(*current, *t)
+		}
+		total.TimingsByWeaponClass[class] = &merged
+	}
+}
+
+func printCareers(careers []*CareerStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "steam id\tnickname\tmatches\twin rate\trounds\tkills\tdeaths\tadr\tkast\trating")
+	for _, c := range careers {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.0f%%\t%v\t%v\t%v\t%.1f\t%.1f\t%.2f\n", c.SteamID, c.Nickname, c.MatchesPlayed, c.WinRate*100, c.Rounds, c.Totals.Kills, c.Totals.Deaths, c.ADR, c.Kast, c.Rating)
+	}
+	w.Flush()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A new stat has to be put in one of the lists, otherwise careers would silently leave it out
+func TestCountersListed(t *testing.T) {
+	typ := reflect.TypeOf(PlayerScore{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Float64, reflect.Map:
+		default:
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		summed, notSummed := slices.Contains(summedCounters, counterName(f)), slices.Contains(notSummedCounters, counterName(f))
+		if summed == notSummed {
+			t.Errorf("%v should be in exactly one of summedCounters and notSummedCounters", counterName(f))
+		}
+	}
+}
+
+func TestAggregateCareers(t *testing.T) {
+	match := func(day int, nickname string) ParsedScoreboard {
+		ps := PlayerScore{
+			SteamID:         1,
+			Nickname:        nickname,
+			Kills:           10,
+			KillsByWeapon:   map[string]int{"ak47": 10},
+			DistanceByRound: map[int]float64{1: 500},
+			MaxSpeed:        float64(200 + day),
+		}
+		return ParsedScoreboard{
+			File:       nickname + "_scoreboard.json",
+			Scoreboard: Scoreboard{RoundsPlayed: 1, MapName: "de_test", MatchDate: time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC), PlayerScores: []PlayerScore{ps}},
+		}
+	}
+
+	// The latest match comes first, as the directory listing can have it
+	careers := aggregateCareers([]ParsedScoreboard{match(3, "latest"), match(1, "first"), match(2, "second")})
+	if len(careers) != 1 {
+		t.Fatalf("got %v careers, want 1", len(careers))
+	}
+
+	c := careers[0]
+	if c.Nickname != "latest" {
+		t.Errorf("nickname is %q, want the one from the latest match", c.Nickname)
+	}
+	if c.Totals.Kills != 30 || c.Totals.KillsByWeapon["ak47"] != 30 {
+		t.Errorf("got %v kills and %v with ak47, want 30 of both", c.Totals.Kills, c.Totals.KillsByWeapon["ak47"])
+	}
+	if c.Totals.DistanceByRound != nil {
+		t.Errorf("distances by round %v were summed over matches", c.Totals.DistanceByRound)
+	}
+	if c.Totals.MaxSpeed != 203 {
+		t.Errorf("max speed is %v, want the fastest 203", c.Totals.MaxSpeed)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reply of <url>/sync, tells where the broadcast is
+type broadcastSync struct {
+	Tick           int     `json:"tick"`
+	Fragment       int     `json:"fragment"`        // Latest fragment with a full snapshot
+	SignupFragment int     `json:"signup_fragment"` // Fragment with the start data
+	TPS            float64 `json:"tps"`
+	Map            string  `json:"map"`
+	Protocol       int     `json:"protocol"`
+}
+
+var (
+	errBroadcastNotReady = errors.New("fragment isn't available yet")
+	errBroadcastRefused  = errors.New("relay refused the request") // Client errors other than 404 don't go away by asking again
+)
+
+// Reads a CS2 broadcast (HLTV relay) as if it were a demo file. Fragments hold demo commands in the same
+// format as the .dem file after its header, so the stream is a made up PBDEMS2 header, the start data, the
+// full snapshot of the current fragment and then the deltas of it and every fragment after it as they appear.
+// The stream ends when no new fragment appears for the timeout or the relay refuses a request. The parser reads
+// a little ahead, so the end of a fragment is handled when the next one arrives
+type broadcastReader struct {
+	ctx     context.Context // Cancelling ends the stream like the end of the broadcast
+	url     string
+	client  *http.Client
+	poll    time.Duration
+	timeout time.Duration
+
+	sync     broadcastSync
+	next     int      // Next delta fragment
+	pending  []string // Parts fetched before the deltas: start and full
+	buf      bytes.Reader
+	lastData time.Time
+	err      error // Why the stream ended early
+}
+
+func newBroadcastReader(ctx context.Context, url string, poll time.Duration, timeout time.Duration) (*broadcastReader, error) {
+	br := &broadcastReader{
+		ctx:     ctx,
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+		poll:    poll,
+		timeout: timeout,
+	}
+
+	if err := br.fetchSync(); err != nil {
+		return nil, err
+	}
+
+	br.next = br.sync.Fragment
+	br.pending = []string{fmt.Sprintf("%v/start", br.sync.SignupFragment), fmt.Sprintf("%v/full", br.sync.Fragment)}
+	// Demo header is the filestamp and two offsets the parser skips
+	header := make([]byte, 16)
+	copy(header, "PBDEMS2\x00")
+	br.buf.Reset(header)
+	br.lastData = time.Now()
+
+	return br, nil
+}
+
+func (br *broadcastReader) fetchSync() error {
+	data, err := br.fetch("sync")
+	if err != nil {
+		return fmt.Errorf("broadcast sync: %w", err)
+	}
+	if err := json.Unmarshal(data, &br.sync); err != nil {
+		return fmt.Errorf("broadcast sync: %w", err)
+	}
+
+	slog.Info(fmt.Sprintf("Broadcast on %v at fragment %v, tick %v", br.sync.Map, br.sync.Fragment, br.sync.Tick))
+
+	return nil
+}
+
+func (br *broadcastReader) fetch(part string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(br.ctx, http.MethodGet, br.url+"/"+part, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := br.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, errBroadcastNotReady
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, fmt.Errorf("%v/%v: %v: %w", br.url, part, resp.Status, errBroadcastRefused)
+	}
+	return nil, fmt.Errorf("%v/%v: %v", br.url, part, resp.Status)
+}
+
+func (br *broadcastReader) Read(p []byte) (int, error) {
+	// The parser can read again after the end, the refused request isn't asked again
+	if br.err != nil {
+		return 0, io.EOF
+	}
+
+	for br.buf.Len() == 0 {
+		part := fmt.Sprintf("%v/delta", br.next)
+		if len(br.pending) > 0 {
+			part = br.pending[0]
+		}
+
+		data, err := br.fetch(part)
+		if err != nil {
+			if br.ctx.Err() != nil {
+				return 0, io.EOF
+			}
+			// The parser panics on read errors, so the stream just ends and the error is returned after parsing
+			if errors.Is(err, errBroadcastRefused) {
+				br.err = err
+				return 0, io.EOF
+			}
+			if time.Since(br.lastData) > br.timeout {
+				slog.Info(fmt.Sprintf("No new broadcast fragments for %v, stopping", br.timeout))
+				return 0, io.EOF
+			}
+			if !errors.Is(err, errBroadcastNotReady) {
+				slog.Warn(fmt.Sprint(err))
+			}
+
+			select {
+			case <-time.After(br.poll):
+			case <-br.ctx.Done():
+			}
+			continue
+		}
+
+		slog.Debug(fmt.Sprintf("Broadcast fragment %v, %v bytes", part, len(data)))
+
+		if len(br.pending) > 0 {
+			br.pending = br.pending[1:]
+		} else {
+			br.next += 1
+		}
+		br.lastData = time.Now()
+		br.buf.Reset(data)
+	}
+
+	return br.buf.Read(p)
+}
+
+// Parses a live match from a broadcast and writes the running scoreboard after every round to stdout as json
+// lines. The scoreboard is saved to the parsed directory when the broadcast ends or parsing is interrupted
+func broadcastCommand(ctx context.Context, args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	name := fs.String("name", "", "demo name for the scoreboard file, default is broadcast_<date>_<map>.dem")
+	rosterFile := fs.String("roster", "data/roster.json", "roster file")
+	poll := fs.Duration("poll", time.Second, "how often a missing fragment is asked again")
+	timeout := fs.Duration("timeout", time.Minute, "the broadcast is over when no fragment appears for this long")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("give the broadcast url, e.g. http://localhost:8080/match/s123t456")
+	}
+
+	roster, err := loadRoster(*rosterFile)
+	if err != nil {
+		return err
+	}
+
+	br, err := newBroadcastReader(ctx, fs.Arg(0), *poll, *timeout)
+	if err != nil {
+		return err
+	}
+
+	demoName := *name
+	if demoName == "" {
+		demoName = fmt.Sprintf("broadcast_%v_%v.dem", time.Now().Format(time.DateOnly), br.sync.Map)
+	}
+
+	opts := parseOptions{roster: roster, matchDate: time.Now(), progress: ndjsonProgress(os.Stdout)}
+
+	// Interrupting ends the stream instead of cancelling the parser, so the rounds so far are saved
+	scoreboard, _, err := parseDemo(context.WithoutCancel(ctx), br, demoName, opts)
+	if err != nil {
+		return err
+	}
+
+	// Broadcasts have no file header with the map
+	if scoreboard.MapName == "" {
+		scoreboard.MapName = br.sync.Map
+	}
+
+	if err := os.MkdirAll(parsedDir, 0755); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Broadcast ended after %v rounds, saving %v", scoreboard.RoundsPlayed, demoName+"_scoreboard.json"))
+
+	if err := scoreboard.saveJson(demoName+"_scoreboard.json", parsedDir); err != nil {
+		return err
+	}
+
+	return br.err
+}
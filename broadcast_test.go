@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Relay serving testdata/broadcast. Requests are recorded in order, refused parts get a 403.
+//
+// The fragments there are made with appendDemoCommand, no real relay capture was at hand: sync points at
+// fragment 2 with the start data (file header of de_test) in fragment 0, 2/full has a sync tick and 2/delta and
+// 3/delta an empty packet each. The tests only rely on the layout the sync gives, so a trimmed real capture can
+// replace them:
+//
+//	curl -o sync $URL/sync
+//	curl --create-dirs -o <signup_fragment>/start $URL/<signup_fragment>/start
+//	curl --create-dirs -o <fragment>/full $URL/<fragment>/full
+//	curl --create-dirs -o <n>/delta $URL/<n>/delta   (n = fragment, fragment+1, ...)
+func testRelay(t *testing.T, refused string) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var requests []string
+
+	files := http.FileServer(http.Dir("testdata/broadcast"))
+	srv := httptest.NewServer(http.StripPrefix("/match", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		part := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		requests = append(requests, part)
+		mu.Unlock()
+
+		if part == refused {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(requests)
+	}
+}
+
+// Sync of the test relay and the delta fragments it has, from the sync's fragment on
+func testRelayLayout(t *testing.T) (broadcastSync, []string) {
+	data, err := os.ReadFile("testdata/broadcast/sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var relay broadcastSync
+	if err := json.Unmarshal(data, &relay); err != nil {
+		t.Fatal(err)
+	}
+
+	var deltas []string
+	for n := relay.Fragment; ; n++ {
+		part := fmt.Sprintf("%v/delta", n)
+		if _, err := os.Stat("testdata/broadcast/" + part); err != nil {
+			break
+		}
+		deltas = append(deltas, part)
+	}
+	if len(deltas) < 2 {
+		t.Fatalf("testdata/broadcast has %v deltas, the tests need at least 2", len(deltas))
+	}
+
+	return relay, deltas
+}
+
+func TestBroadcastCommand(t *testing.T) {
+	relay, deltas := testRelayLayout(t)
+	srv, requests := testRelay(t, "")
+	parsedDir := t.TempDir() + "/"
+
+	start := time.Now()
+	args := []string{"-name", "live.dem", "-roster", parsedDir + "roster.json", "-poll", "10ms", "-timeout", "200ms", srv.URL + "/match"}
+	if err := broadcastCommand(context.Background(), args, parsedDir); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("took %v, the broadcast should end 200ms after the last fragment", took)
+	}
+
+	// Start and full come before the deltas, which are asked from the full snapshot's fragment on
+	missing := fmt.Sprintf("%v/delta", relay.Fragment+len(deltas))
+	want := []string{"sync", fmt.Sprintf("%v/start", relay.SignupFragment), fmt.Sprintf("%v/full", relay.Fragment)}
+	want = append(append(want, deltas...), missing)
+
+	got := requests()
+	if len(got) < len(want) || !slices.Equal(got[:len(want)], want) {
+		t.Fatalf("requests %v, want %v and then %v again until the timeout", got, want, missing)
+	}
+	for _, part := range got[len(want):] {
+		if part != missing {
+			t.Errorf("asked %v after %v", part, missing)
+		}
+	}
+
+	data, err := os.ReadFile(parsedDir + "live.dem_scoreboard.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb Scoreboard
+	if err := json.Unmarshal(data, &sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.MapName != relay.Map {
+		t.Errorf("map is %q, want %v from the broadcast", sb.MapName, relay.Map)
+	}
+}
+
+func TestBroadcastRefused(t *testing.T) {
+	_, deltas := testRelayLayout(t)
+	srv, requests := testRelay(t, deltas[1])
+	parsedDir := t.TempDir() + "/"
+
+	start := time.Now()
+	args := []string{"-name", "live.dem", "-roster", parsedDir + "roster.json", "-poll", "10ms", "-timeout", "1m", srv.URL + "/match"}
+	err := broadcastCommand(context.Background(), args, parsedDir)
+	if !errors.Is(err, errBroadcastRefused) {
+		t.Fatalf("error is %v, want %v", err, errBroadcastRefused)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("took %v, a refused request shouldn't be asked again until the timeout", took)
+	}
+	if got := requests(); slices.Index(got, deltas[1]) != len(got)-1 {
+		t.Errorf("requests %v, want to stop at the refused %v", got, deltas[1])
+	}
+
+	// Rounds before the relay refused are still saved
+	if _, err := os.Stat(parsedDir + "live.dem_scoreboard.json"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBroadcastNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	if _, err := newBroadcastReader(context.Background(), srv.URL, 10*time.Millisecond, time.Second); err == nil {
+		t.Fatal("started a broadcast without a sync")
+	}
+}
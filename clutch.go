@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+
+	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+const (
+	ClutchWin   = "win"
+	ClutchLost  = "lost"
+	ClutchSaved = "saved"
+)
+
+// One clutch situation. Only the first player left alone in a round is clutching,
+// the last enemy standing after that isn't counted as a separate 1v1
+type ClutchSituation struct {
+	SteamID       uint64  `json:"steam_id"`
+	Round         int     `json:"round"`
+	Side          int     `json:"side"`
+	EnemiesAlive  int     `json:"enemies_alive"`
+	Kills         int     `json:"kills"`
+	Result        string  `json:"result"`
+	TimeRemaining float64 `json:"time_remaining"` // Seconds left on the round timer when the clutch started
+}
+
+// Called after a kill when the victim's team has only one player left
+func (rs *RoundStats) startClutch(victim *common.Player, round int, timeRemaining time.Duration) {
+	if rs.Clutch != nil || rs.RoundEnded || victim == nil || victim.TeamState == nil {
+		return
+	}
+
+	var clutcher *common.Player
+	for _, member := range victim.TeamState.Members() {
+		if member.IsAlive() && member.SteamID64 != victim.SteamID64 {
+			clutcher = member
+			break
+		}
+	}
+
+	if clutcher == nil {
+		return
+	}
+
+	enemiesAlive := 0
+	for _, enemy := range victim.TeamState.Opponent.Members() {
+		if enemy.IsAlive() {
+			enemiesAlive += 1
+		}
+	}
+
+	if enemiesAlive == 0 {
+		return
+	}
+
+	rs.ClutchingPlayer = clutcher
+	rs.Clutch = &ClutchSituation{
+		SteamID:       clutcher.SteamID64,
+		Round:         round,
+		Side:          int(clutcher.Team),
+		EnemiesAlive:  enemiesAlive,
+		TimeRemaining: max(timeRemaining.Seconds(), 0),
+	}
+}
+
+func (rs *RoundStats) updateClutchKill(killer *common.Player, victim *common.Player) {
+	if rs.Clutch == nil || rs.RoundEnded || killer == nil || victim == nil {
+		return
+	}
+
+	if killer.SteamID64 == rs.Clutch.SteamID && victim.Team != killer.Team {
+		rs.Clutch.Kills += 1
+	}
+}
+
+// Clutch is saved if the clutching player survives a lost round
+func (rs *RoundStats) finishClutch(winner common.Team) *ClutchSituation {
+	if rs.Clutch == nil {
+		return nil
+	}
+
+	switch {
+	case rs.ClutchingPlayer.Team == winner:
+		rs.Clutch.Result = ClutchWin
+	case rs.ClutchingPlayer.IsAlive():
+		rs.Clutch.Result = ClutchSaved
+	default:
+		rs.Clutch.Result = ClutchLost
+	}
+
+	return rs.Clutch
+}
+
+// Per player clutch counters are derived from the recorded clutch situations
+func (sb *Scoreboard) updateClutchCounters() {
+	for i := range sb.PlayerScores {
+		ps := &sb.PlayerScores[i]
+		ps.ClutchV1Count, ps.ClutchV2Count, ps.ClutchV3Count, ps.ClutchV4Count, ps.ClutchV5Count = 0, 0, 0, 0, 0
+		ps.ClutchV1Wins, ps.ClutchV2Wins, ps.ClutchV3Wins, ps.ClutchV4Wins, ps.ClutchV5Wins = 0, 0, 0, 0, 0
+		ps.ClutchLosses, ps.ClutchSaves = 0, 0
+
+		for _, c := range sb.Clutches {
+			if c.SteamID != ps.SteamID {
+				continue
+			}
+
+			win := boolToInt(c.Result == ClutchWin)
+
+			switch c.EnemiesAlive {
+			case 1:
+				ps.ClutchV1Count += 1
+				ps.ClutchV1Wins += win
+			case 2:
+				ps.ClutchV2Count += 1
+				ps.ClutchV2Wins += win
+			case 3:
+				ps.ClutchV3Count += 1
+				ps.ClutchV3Wins += win
+			case 4:
+				ps.ClutchV4Count += 1
+				ps.ClutchV4Wins += win
+			case 5:
+				ps.ClutchV5Count += 1
+				ps.ClutchV5Wins += win
+			}
+
+			switch c.Result {
+			case ClutchLost:
+				ps.ClutchLosses += 1
+			case ClutchSaved:
+				ps.ClutchSaves += 1
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+// Matrix of something one player did to another, indexed [from][to] by SteamID64
+type PlayerMatrix[T int | float64] map[uint64]map[uint64]T
+
+func (m PlayerMatrix[T]) add(from *common.Player, to *common.Player, value T) {
+	m.addIDs(getSteamID64(from), getSteamID64(to), value)
+}
+
+// For scoreboards and events without player refs
+func (m PlayerMatrix[T]) addIDs(fromID uint64, toID uint64, value T) {
+	if fromID == 0 || toID == 0 || fromID == toID {
+		return
+	}
+
+	if m[fromID] == nil {
+		m[fromID] = make(map[uint64]T)
+	}
+	m[fromID][toID] += value
+}
+
+func (m PlayerMatrix[T]) get(from uint64, to uint64) T {
+	return m[from][to]
+}
+
+func duelCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("duel", flag.ExitOnError)
+	playerA := fs.Uint64("a", 0, "first player (SteamID64)")
+	playerB := fs.Uint64("b", 0, "second player (SteamID64)")
+	fs.Parse(args)
+
+	if *playerA == 0 || *playerB == 0 {
+		return fmt.Errorf("both players are required, e.g. duel -a 7656119... -b 7656119...")
+	}
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	nameA, nameB := fmt.Sprint(*playerA), fmt.Sprint(*playerB)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "match\tmap\tkills a>b\tkills b>a\tdamage a>b\tdamage b>a\tflashed a>b (s)\tflashed b>a (s)")
+
+	var kills, damage [2]int
+	var flashed [2]float64
+	matches := 0
+
+	for _, sb := range scoreboards {
+		if sb.getPlayer(*playerA) == nil || sb.getPlayer(*playerB) == nil {
+			continue
+		}
+
+		nameA, nameB = sb.getPlayer(*playerA).Nickname, sb.getPlayer(*playerB).Nickname
+		matches += 1
+
+		k := [2]int{sb.KillMatrix.get(*playerA, *playerB), sb.KillMatrix.get(*playerB, *playerA)}
+		d := [2]int{sb.DamageMatrix.get(*playerA, *playerB), sb.DamageMatrix.get(*playerB, *playerA)}
+		f := [2]float64{sb.FlashMatrix.get(*playerA, *playerB), sb.FlashMatrix.get(*playerB, *playerA)}
+
+		for i := range 2 {
+			kills[i] += k[i]
+			damage[i] += d[i]
+			flashed[i] += f[i]
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%.1f\t%.1f\n", sb.File, sb.MapName, k[0], k[1], d[0], d[1], f[0], f[1])
+	}
+
+	fmt.Fprintf(w, "total (%v matches)\t\t%v\t%v\t%v\t%v\t%.1f\t%.1f\n", matches, kills[0], kills[1], damage[0], damage[1], flashed[0], flashed[1])
+	w.Flush()
+
+	fmt.Printf("\na = %v (%v), b = %v (%v)\n", nameA, *playerA, nameB, *playerB)
+
+	return nil
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/geo/r3"
+	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+// Bump when the cached events change, older caches are refused and the demos have to be parsed again
+const eventCacheVersion = 1
+
+const eventCacheMagic = "csdemoparser-events"
+
+type EventKind uint8
+
+const (
+	EventRoundStart EventKind = iota + 1
+	EventRoundEnd
+	EventKill
+	EventHurt
+	EventResidualDamage // Damage of killing blows, known only at the end of the round
+	EventFlash
+	EventGrenade
+	EventPlayer // Player snapshot at the end of a round
+)
+
+type EventCacheHeader struct {
+	Magic          string
+	Version        int
+	Demo           string
+	Map            string
+	MatchDate      time.Time
+	MatchStartTick int
+	MaxRounds      int
+	EventCount     int
+}
+
+// One struct for every kind of event, gob leaves out the zero fields so unused ones take no space
+type CachedEvent struct {
+	Kind       EventKind
+	Tick       int32
+	Time       time.Duration
+	Round      int16
+	Player     uint64 // Killer, attacker, flasher, thrower or the player of a snapshot
+	Target     uint64 // Victim, damaged or flashed player
+	Assister   uint64
+	Side       int8
+	TargetSide int8
+	Enemy      bool   // Player and target are on different teams
+	Weapon     string // Weapon name, or grenade type for grenades
+	WeaponType int16
+	Value      int32 // Kill type bits, damage or round winner
+	Reason     int8
+	Duration   float32 // Seconds flashed
+	Pos        [3]float32
+	TargetPos  [3]float32
+	Snapshot   *PlayerSnapshot
+}
+
+type PlayerSnapshot struct {
+	Name       string
+	Clan       string
+	TeamId     int
+	Alive      bool
+	Kills      int
+	Assists    int
+	Deaths     int
+	Mvps       int
+	MoneySpent int
+	TeamRounds int
+}
+
+type EventCache struct {
+	EventCacheHeader
+	Events []CachedEvent
+}
+
+func cachePos(v r3.Vector) [3]float32 {
+	return [3]float32{float32(v.X), float32(v.Y), float32(v.Z)}
+}
+
+func playerPos(p *common.Player) [3]float32 {
+	if p == nil || p.Entity == nil {
+		return [3]float32{}
+	}
+	return cachePos(p.Position())
+}
+
+// Nil cache records nothing, so the handlers can call this without checking if caching is on
+func (c *EventCache) add(e CachedEvent) {
+	if c == nil {
+		return
+	}
+	c.Events = append(c.Events, e)
+}
+
+// Events before the match start are thrown away like the scoreboard
+func (c *EventCache) reset() {
+	if c == nil {
+		return
+	}
+	c.Events = nil
+}
+
+func eventCachePath(eventsDir string, demo string) string {
+	return filepath.Join(eventsDir, demo+".events")
+}
+
+// Written to a temporary file first so a crash doesn't leave a half written cache behind
+func (c *EventCache) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		enc := gob.NewEncoder(gz)
+
+		c.Magic = eventCacheMagic
+		c.Version = eventCacheVersion
+		c.EventCount = len(c.Events)
+
+		if err := enc.Encode(c.EventCacheHeader); err != nil {
+			return err
+		}
+		for _, e := range c.Events {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+
+		return gz.Close()
+	})
+}
+
+func loadEventCache(path string) (*EventCache, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v is not an event cache: %w", path, err)
+	}
+	dec := gob.NewDecoder(gz)
+
+	c := &EventCache{}
+	if err := dec.Decode(&c.EventCacheHeader); err != nil || c.Magic != eventCacheMagic {
+		return nil, fmt.Errorf("%v is not an event cache", path)
+	}
+	if c.Version != eventCacheVersion {
+		return nil, fmt.Errorf("%v has event cache version %v, expected %v. Parse the demo again with --cache-events", path, c.Version, eventCacheVersion)
+	}
+
+	c.Events = make([]CachedEvent, 0, c.EventCount)
+	for {
+		var e CachedEvent
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %w", path, err)
+		}
+		c.Events = append(c.Events, e)
+	}
+
+	if len(c.Events) != c.EventCount {
+		return nil, fmt.Errorf("%v is truncated, %v of %v events", path, len(c.Events), c.EventCount)
+	}
+
+	return c, nil
+}
+
+func recomputeCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("recompute", flag.ExitOnError)
+	eventsDir := fs.String("events", "data/events/", "directory of the event caches")
+	out := fs.String("out", "data/recomputed/", "directory for the recomputed scoreboards")
+	rosterFile := fs.String("roster", "data/roster.json", "roster file")
+	fs.Parse(args)
+
+	roster, err := loadRoster(*rosterFile)
+	if err != nil {
+		return err
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		entries, err := os.ReadDir(*eventsDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".events") {
+				files = append(files, entry.Name())
+			}
+		}
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+
+	recomputed := 0
+	for _, name := range files {
+		path := name
+		if _, err := os.Stat(path); err != nil {
+			path = filepath.Join(*eventsDir, name)
+		}
+
+		cache, err := loadEventCache(path)
+		if err != nil {
+			slog.Error(fmt.Sprint(err))
+			continue
+		}
+
+		sb := recomputeScoreboard(cache, roster)
+		if err := sb.saveJson(cache.Demo+"_scoreboard.json", filepath.Clean(*out)+"/"); err != nil {
+			return err
+		}
+		recomputed += 1
+	}
+
+	slog.Info(fmt.Sprintf("Recomputed %v scoreboards from event caches to %v", recomputed, *out))
+
+	return nil
+}
+
+// Per round state while replaying events, like RoundStats in the parser
+type replayRound struct {
+	kastRound
+	ctPlayers []uint64
+	tPlayers  []uint64
+}
+
+func newReplayRound() replayRound {
+	return replayRound{kastRound: newKastRound()}
+}
+
+// Stats of the parse that the event cache doesn't have
+var recomputeMissingCollectors = []string{"movement", "timings", "clutches", "shots", "reloads", "chicken_kills"}
+
+// Rebuilds a scoreboard from cached events. Stats that need every frame (movement, timings, shots, clutches),
+// reloads and chicken kills aren't in the cache and are left empty
+func recomputeScoreboard(cache *EventCache, roster *Roster) Scoreboard {
+	sb := Scoreboard{
+		MapName:        cache.Map,
+		MatchDate:      cache.MatchDate,
+		MatchStartTick: cache.MatchStartTick,
+		MaxRounds:      cache.MaxRounds,
+		TeamMemebers:   make(map[int][]uint64),
+		KillMatrix:     make(PlayerMatrix[int]),
+		DamageMatrix:   make(PlayerMatrix[int]),
+		FlashMatrix:    make(PlayerMatrix[float64]),
+		KDTypeBits:     map[int]string{0: "teamkill", 1: "through smoke", 2: "wallbang", 3: "headshot", 4: "no scope", 5: "attacker blind", 6: "victim flashed", 7: "suicide"},
+		roster:         roster,
+	}
+
+	// Every player is added before replaying, so pointers to the player scores stay valid
+	for _, e := range cache.Events {
+		for _, id := range []uint64{e.Player, e.Target, e.Assister} {
+			if id != 0 && sb.getPlayer(id) == nil {
+				sb.PlayerScores = append(sb.PlayerScores, PlayerScore{
+					SteamID:              id,
+					KillsByWeapon:        make(map[string]int),
+					DeathsByWeapon:       make(map[string]int),
+					KillsByType:          make(map[uint32]int),
+					DeathsByType:         make(map[uint32]int),
+					DistanceByRound:      make(map[int]float64),
+					TimingsByWeaponClass: make(map[string]*TimingStats),
+				})
+			}
+		}
+	}
+
+	// First snapshot of a player gives the name and team, like the first sighting in the parser
+	for _, e := range cache.Events {
+		if e.Kind != EventPlayer || e.Snapshot == nil {
+			continue
+		}
+		ps := sb.getPlayer(e.Player)
+		if ps.Nickname != "" {
+			continue
+		}
+		ps.Nickname = e.Snapshot.Name
+		ps.Team = e.Snapshot.Clan
+		ps.TeamId = e.Snapshot.TeamId
+		ps.addAlias(e.Snapshot.Name)
+		ps.applyRoster(roster, sb.MatchDate)
+	}
+
+	player := func(id uint64) *PlayerScore {
+		if ps := sb.getPlayer(id); ps != nil {
+			return ps
+		}
+		return &PlayerScore{KillsByWeapon: make(map[string]int), DeathsByWeapon: make(map[string]int), KillsByType: make(map[uint32]int), DeathsByType: make(map[uint32]int)}
+	}
+
+	position := func(eventType string, id uint64, side int8, round int16, pos [3]float32) {
+		if id == 0 {
+			return
+		}
+		sb.Positions = append(sb.Positions, PositionEvent{Type: eventType, SteamID: id, Side: int(side), Round: int(round), X: float64(pos[0]), Y: float64(pos[1]), Z: float64(pos[2])})
+	}
+
+	round := newReplayRound()
+
+	for _, e := range cache.Events {
+		switch e.Kind {
+		case EventRoundStart:
+			round = newReplayRound()
+
+		case EventKill:
+			killer, victim, assister := player(e.Player), player(e.Target), player(e.Assister)
+			killtype := uint32(e.Value)
+
+			position("kill", e.Player, e.Side, e.Round, e.Pos)
+			position("death", e.Target, e.TargetSide, e.Round, e.TargetPos)
+
+			if e.Weapon != "" {
+				killer.KillsByWeapon[e.Weapon] += 1
+				victim.DeathsByWeapon[e.Weapon] += 1
+			}
+
+			round.addKill(e.Player, e.Target, e.Assister, e.Time)
+			sb.KillMatrix.addIDs(e.Player, e.Target, 1)
+
+			killer.KillsByType[killtype] += 1
+			victim.DeathsByType[killtype] += 1
+
+			sb.Kills = append(sb.Kills, KillEvent{
+				Round:    int(e.Round),
+				Time:     e.Time.Seconds(),
+				Killer:   e.Player,
+				Victim:   e.Target,
+				Assister: e.Assister,
+				Weapon:   e.Weapon,
+				KillType: killtype,
+				Side:     int(e.Side),
+			})
+
+			if e.WeaponType == 407 { // 407 World damage
+				victim.Suicides += 1
+				continue
+			}
+
+			if e.Enemy {
+				round.addEnemyKill(killer, victim)
+			}
+
+			addKillCounters(killer, victim, assister, killtype, e.Enemy)
+
+		case EventHurt:
+			sb.DamageMatrix.addIDs(e.Player, e.Target, int(e.Value))
+			addDamageCounters(player(e.Player), player(e.Target), int(e.Value), common.EquipmentType(e.WeaponType), e.Enemy)
+
+		case EventResidualDamage:
+			player(e.Player).DamageDone += int(e.Value)
+			if sb.DamageMatrix[e.Player] == nil {
+				sb.DamageMatrix[e.Player] = make(map[uint64]int)
+			}
+			sb.DamageMatrix[e.Player][e.Target] += int(e.Value)
+
+		case EventFlash:
+			attacker := player(e.Player)
+			if e.Target != 0 {
+				sb.FlashMatrix.addIDs(e.Player, e.Target, float64(e.Duration))
+				addFlashCounters(attacker, player(e.Target), e.Duration, e.Enemy)
+			} else if e.Enemy {
+				attacker.EnemiesFullFlashed += 1
+			} else {
+				attacker.TeammatesFullFlashed += 1
+			}
+
+		case EventGrenade:
+			thrower := player(e.Player)
+			switch e.Weapon {
+			case "flash":
+				thrower.FlashesThrown += 1
+			case "he":
+				thrower.HesThrown += 1
+			case "smoke":
+				thrower.SmokesThrown += 1
+			case "decoy":
+				thrower.DecoysThrown += 1
+			case "molotov":
+				thrower.BurnsThrown += 1
+			}
+			position(e.Weapon, e.Player, e.Side, e.Round, e.Pos)
+
+		case EventPlayer:
+			ps := player(e.Player)
+			s := e.Snapshot
+			if s == nil {
+				continue
+			}
+
+			ps.Kills = s.Kills
+			ps.Assists = s.Assists
+			ps.Deaths = s.Deaths
+			ps.Mvps = s.Mvps
+			ps.MoneySpentTotal = s.MoneySpent
+			ps.TeamRounds = s.TeamRounds
+			ps.TeamId = s.TeamId
+			ps.PlayedRounds += 1
+			ps.addAlias(s.Name)
+
+			round.endRound(ps, s.Alive)
+
+			switch e.Side {
+			case 3:
+				round.ctPlayers = append(round.ctPlayers, e.Player)
+			case 2:
+				round.tPlayers = append(round.tPlayers, e.Player)
+			}
+
+		case EventRoundEnd:
+			sb.Rounds = append(sb.Rounds, RoundResult{
+				Round:     int(e.Round),
+				Winner:    int(e.Value),
+				Reason:    int(e.Reason),
+				CTPlayers: round.ctPlayers,
+				TPlayers:  round.tPlayers,
+			})
+			sb.RoundsPlayed = int(e.Round)
+			sb.addRoundSnapshot()
+		}
+	}
+
+	for _, ps := range sb.PlayerScores {
+		sb.TeamMemebers[ps.TeamId] = append(sb.TeamMemebers[ps.TeamId], ps.SteamID)
+	}
+
+	sb.updatePostMatchStats()
+
+	sb.warn(WarnMissingCollectors, 0, fmt.Sprintf("Recomputed %v from the event cache without %v", cache.Demo, strings.Join(recomputeMissingCollectors, ", ")))
+
+	return sb
+}
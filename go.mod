@@ -2,10 +2,14 @@ module demoparser
 
 go 1.23.3
 
-require github.com/markus-wa/demoinfocs-golang/v4 v4.3.0
+require (
+	github.com/golang/geo v0.0.0-20230421003525-6adc56603217
+	github.com/klauspost/compress v1.17.9
+	github.com/markus-wa/demoinfocs-golang/v4 v4.3.0
+	google.golang.org/protobuf v1.35.2
+)
 
 require (
-	github.com/golang/geo v0.0.0-20230421003525-6adc56603217 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/markus-wa/go-unassert v0.1.3 // indirect
 	github.com/markus-wa/gobitread v0.2.4 // indirect
@@ -14,5 +18,4 @@ require (
 	github.com/markus-wa/quickhull-go/v2 v2.2.0 // indirect
 	github.com/oklog/ulid/v2 v2.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	google.golang.org/protobuf v1.35.2 // indirect
 )
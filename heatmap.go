@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const heatmapSize = 1024 // Radar images are 1024x1024, so the canvas is the same size
+
+// Radar overview values (pos_x, pos_y, scale) from the game's resource/overviews/<map>.txt files
+type MapCalibration struct {
+	PosX  float64 `json:"pos_x"`
+	PosY  float64 `json:"pos_y"`
+	Scale float64 `json:"scale"`
+}
+
+var defaultCalibrations = map[string]MapCalibration{
+	"de_ancient":  {PosX: -2953, PosY: 2164, Scale: 5},
+	"de_anubis":   {PosX: -2796, PosY: 3328, Scale: 5.22},
+	"de_dust2":    {PosX: -2476, PosY: 3239, Scale: 4.4},
+	"de_inferno":  {PosX: -2087, PosY: 3870, Scale: 4.9},
+	"de_mirage":   {PosX: -3230, PosY: 1713, Scale: 5},
+	"de_nuke":     {PosX: -3453, PosY: 2887, Scale: 7},
+	"de_overpass": {PosX: -4831, PosY: 1781, Scale: 5.2},
+	"de_train":    {PosX: -2308, PosY: 2078, Scale: 4.082077},
+	"de_vertigo":  {PosX: -3168, PosY: 1762, Scale: 4},
+	"cs_italy":    {PosX: -2647, PosY: 2592, Scale: 4.6},
+	"cs_office":   {PosX: -1838, PosY: 1858, Scale: 4.1},
+}
+
+var heatmapLayers = []string{"kill", "death", "flash", "he", "smoke", "molotov", "decoy"}
+
+var heatmapColors = map[string]string{
+	"kill":    "#ff3b30",
+	"death":   "#5ac8fa",
+	"flash":   "#ffffff",
+	"he":      "#ff9500",
+	"smoke":   "#8e8e93",
+	"molotov": "#ff2d55",
+	"decoy":   "#34c759",
+}
+
+type heatmapOptions struct {
+	outDir       string
+	radarDir     string
+	layers       []string
+	calibrations map[string]MapCalibration
+}
+
+func heatmapCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("heatmap", flag.ExitOnError)
+	outDir := fs.String("out", "data/heatmaps/", "directory where the svg files are written")
+	radarDir := fs.String("radar", "", "directory with radar images named <map>.png or <map>.jpg")
+	calibrationFile := fs.String("calibration", "", "json file with map calibrations {\"<map>\": {\"pos_x\": 0, \"pos_y\": 0, \"scale\": 1}}")
+	layers := fs.String("layers", strings.Join(heatmapLayers, ","), "comma separated layers to draw")
+	mapFilter := fs.String("map", "", "only draw this map")
+	playerFilter := fs.Uint64("player", 0, "only draw this player (SteamID64)")
+	sideFilter := fs.String("side", "", "only draw this side (ct or t)")
+	fs.Parse(args)
+
+	opts := heatmapOptions{
+		outDir:       *outDir,
+		radarDir:     *radarDir,
+		calibrations: make(map[string]MapCalibration),
+	}
+
+	for name, c := range defaultCalibrations {
+		opts.calibrations[name] = c
+	}
+
+	if *calibrationFile != "" {
+		data, err := os.ReadFile(*calibrationFile)
+		if err != nil {
+			return err
+		}
+
+		var custom map[string]MapCalibration
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return fmt.Errorf("invalid calibration file %v: %w", *calibrationFile, err)
+		}
+
+		for name, c := range custom {
+			opts.calibrations[name] = c
+		}
+	}
+
+	for _, l := range strings.Split(*layers, ",") {
+		l = strings.TrimSpace(l)
+		if !slices.Contains(heatmapLayers, l) {
+			return fmt.Errorf("unknown heatmap layer %q, available layers: %v", l, strings.Join(heatmapLayers, ", "))
+		}
+		opts.layers = append(opts.layers, l)
+	}
+
+	sides := []string{"all", "ct", "t"}
+	if *sideFilter != "" {
+		if !slices.Contains(sides, *sideFilter) {
+			return fmt.Errorf("unknown side %q, use ct or t", *sideFilter)
+		}
+		sides = []string{*sideFilter}
+	}
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	// Collect positions per map
+	positions := make(map[string][]PositionEvent)
+	for _, sb := range scoreboards {
+		if *mapFilter != "" && sb.MapName != *mapFilter {
+			continue
+		}
+		positions[sb.MapName] = append(positions[sb.MapName], sb.Positions...)
+	}
+
+	if err := os.MkdirAll(opts.outDir, 0755); err != nil {
+		return err
+	}
+
+	for mapName, events := range positions {
+		players := []uint64{0}
+		if *playerFilter != 0 {
+			players = []uint64{*playerFilter}
+		} else {
+			for _, e := range events {
+				if !slices.Contains(players, e.SteamID) {
+					players = append(players, e.SteamID)
+				}
+			}
+		}
+
+		for _, player := range players {
+			for _, side := range sides {
+				selected := filterPositions(events, player, side)
+				if len(selected) == 0 {
+					continue
+				}
+
+				name := mapName
+				if player != 0 {
+					name += "_" + strconv.FormatUint(player, 10)
+				}
+				name += "_" + side + ".svg"
+
+				if err := writeHeatmap(filepath.Join(opts.outDir, name), mapName, selected, opts); err != nil {
+					return err
+				}
+			}
+		}
+
+		slog.Info(fmt.Sprintf("Heatmaps for %v written to %v", mapName, opts.outDir))
+	}
+
+	return nil
+}
+
+// Player 0 means all players
+func filterPositions(events []PositionEvent, player uint64, side string) []PositionEvent {
+	var selected []PositionEvent
+	for _, e := range events {
+		if player != 0 && e.SteamID != player {
+			continue
+		}
+		if side == "t" && e.Side != 2 || side == "ct" && e.Side != 3 {
+			continue
+		}
+		selected = append(selected, e)
+	}
+	return selected
+}
+
+func (c MapCalibration) toCanvas(x float64, y float64) (float64, float64) {
+	return (x - c.PosX) / c.Scale, (c.PosY - y) / c.Scale
+}
+
+// Maps without calibration data are fitted to the canvas from the bounds of the positions
+func fitCalibration(events []PositionEvent) MapCalibration {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, e := range events {
+		minX, maxX = min(minX, e.X), max(maxX, e.X)
+		minY, maxY = min(minY, e.Y), max(maxY, e.Y)
+	}
+
+	margin := 0.05
+	span := max(maxX-minX, maxY-minY, 1) * (1 + 2*margin)
+
+	return MapCalibration{
+		PosX:  minX - span*margin,
+		PosY:  maxY + span*margin,
+		Scale: span / heatmapSize,
+	}
+}
+
+func writeHeatmap(path string, mapName string, events []PositionEvent, opts heatmapOptions) error {
+	calibration, ok := opts.calibrations[mapName]
+	if !ok {
+		slog.Warn(fmt.Sprintf("No calibration for map %v, fitting heatmap to the positions", mapName))
+		calibration = fitCalibration(events)
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", heatmapSize, heatmapSize, heatmapSize, heatmapSize)
+	b.WriteString(`<defs><filter id="heat" x="-50%" y="-50%" width="200%" height="200%"><feGaussianBlur stdDeviation="6"/></filter></defs>` + "\n")
+
+	radar := radarImage(opts.radarDir, mapName)
+	if radar != "" {
+		fmt.Fprintf(&b, `<image href="%s" x="0" y="0" width="%d" height="%d"/>`+"\n", radar, heatmapSize, heatmapSize)
+	} else {
+		b.WriteString(`<rect width="100%" height="100%" fill="#1c1c1e"/>` + "\n")
+	}
+
+	for i, layer := range opts.layers {
+		fmt.Fprintf(&b, `<g id="%s" fill="%s" fill-opacity="0.35" filter="url(#heat)">`+"\n", layer, heatmapColors[layer])
+		count := 0
+		for _, e := range events {
+			if e.Type != layer {
+				continue
+			}
+			x, y := calibration.toCanvas(e.X, e.Y)
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="10"/>`+"\n", x, y)
+			count++
+		}
+		b.WriteString("</g>\n")
+
+		// Legend
+		fmt.Fprintf(&b, `<text x="10" y="%d" fill="%s" font-family="sans-serif" font-size="14">%s (%d)</text>`+"\n", 20+i*18, heatmapColors[layer], layer, count)
+	}
+
+	b.WriteString("</svg>\n")
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// Radar image is embedded to the svg so the file works on its own
+func radarImage(radarDir string, mapName string) string {
+	if radarDir == "" {
+		return ""
+	}
+
+	for _, ext := range []string{"png", "jpg", "jpeg"} {
+		data, err := os.ReadFile(filepath.Join(radarDir, mapName+"."+ext))
+		if err != nil {
+			continue
+		}
+
+		mime := "image/png"
+		if ext != "png" {
+			mime = "image/jpeg"
+		}
+		return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+
+	slog.Warn(fmt.Sprintf("No radar image for %v in %v", mapName, radarDir))
+	return ""
+}
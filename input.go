@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Demo in the demos directory. Compressed demos and demos in zip archives are decompressed while reading,
+// they are never extracted to disk
+type demoInput struct {
+	Name    string // Name of the .dem file, outputs and the manifest use this
+	Path    string // File on disk
+	Entry   string // File inside a zip archive
+	ModTime time.Time
+}
+
+var compressedExtensions = []string{".dem.gz", ".dem.bz2", ".dem.zst"}
+
+func (in demoInput) String() string {
+	if in.Entry != "" {
+		return in.Path + ":" + in.Entry
+	}
+	return in.Path
+}
+
+// Every demo in the directory, including the ones in compressed files and zip archives
+func listDemoInputs(demosDir string) ([]demoInput, error) {
+	files, err := os.ReadDir(demosDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []demoInput
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+		filePath := filepath.Join(demosDir, file.Name())
+
+		switch name := file.Name(); {
+		case strings.HasSuffix(name, ".dem"):
+			inputs = append(inputs, demoInput{Name: name, Path: filePath, ModTime: info.ModTime()})
+		case strings.HasSuffix(name, ".zip"):
+			zipInputs, err := listZipDemos(filePath)
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Skipping %v: %v", name, err))
+				continue
+			}
+			inputs = append(inputs, zipInputs...)
+		default:
+			for _, ext := range compressedExtensions {
+				if strings.HasSuffix(name, ext) {
+					inputs = append(inputs, demoInput{Name: strings.TrimSuffix(name, ext) + ".dem", Path: filePath, ModTime: info.ModTime()})
+				}
+			}
+		}
+	}
+
+	// The same demo can be in the directory both as is and compressed, the first one is parsed
+	sort.SliceStable(inputs, func(i, j int) bool { return inputs[i].Name < inputs[j].Name })
+
+	return inputs, nil
+}
+
+func listZipDemos(zipPath string) ([]demoInput, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var inputs []demoInput
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, ".dem") && !f.FileInfo().IsDir() {
+			inputs = append(inputs, demoInput{Name: path.Base(f.Name), Path: zipPath, Entry: f.Name, ModTime: f.Modified})
+		}
+	}
+	return inputs, nil
+}
+
+// Closes the decompressor and the file under it
+type multiCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+func (m *multiCloser) Close() error {
+	var first error
+	for _, c := range m.closers {
+		if err := c(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Opens the demo as a stream of the uncompressed .dem
+func (in demoInput) open() (io.ReadCloser, error) {
+	if in.Entry != "" {
+		r, err := zip.OpenReader(in.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if f.Name == in.Entry {
+				rc, err := f.Open()
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				return &multiCloser{Reader: rc, closers: []func() error{rc.Close, r.Close}}, nil
+			}
+		}
+		r.Close()
+		return nil, fmt.Errorf("%v not found in %v", in.Entry, in.Path)
+	}
+
+	file, err := os.Open(in.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(in.Path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &multiCloser{Reader: gz, closers: []func() error{gz.Close, file.Close}}, nil
+	case strings.HasSuffix(in.Path, ".bz2"):
+		return &multiCloser{Reader: bzip2.NewReader(file), closers: []func() error{file.Close}}, nil
+	case strings.HasSuffix(in.Path, ".zst"):
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &multiCloser{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, file.Close}}, nil
+	}
+
+	return file, nil
+}
+
+// Hash of the uncompressed demo, so the same demo compressed differently has the same hash
+func (in demoInput) hash() (string, error) {
+	r, err := in.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Demo given as a path on the command line, compressed and zipped ones like in the demos directory.
+// Zip archives must have exactly one demo
+func fileDemoInput(filePath string) (demoInput, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return demoInput{}, err
+	}
+
+	if strings.HasSuffix(filePath, ".zip") {
+		inputs, err := listZipDemos(filePath)
+		if err != nil {
+			return demoInput{}, err
+		}
+		if len(inputs) != 1 {
+			return demoInput{}, fmt.Errorf("%v has %v demos, expected one", filePath, len(inputs))
+		}
+		return inputs[0], nil
+	}
+
+	name := filepath.Base(filePath)
+	for _, ext := range compressedExtensions {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext) + ".dem"
+		}
+	}
+
+	return demoInput{Name: name, Path: filePath, ModTime: info.ModTime()}, nil
+}
+
+// Streams have no filename, so compression is recognized from the first bytes. Closing doesn't close r
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+
+	return io.NopCloser(br), nil
+}
+
+// Parses one demo from a file or stdin and writes the scoreboard to stdout, e.g. curl ... | demoparser parse - | jq
+func parseCommand(ctx context.Context, args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("parse", flag.ExitOnError)
+	name := fs.String("name", "", "demo name for logs and the match date, default is the filename or stdin.dem")
+	out := fs.String("out", "-", "file for the scoreboard json, - for stdout")
+	rosterFile := fs.String("roster", "data/roster.json", "roster file")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up when parsing takes longer than this, 0 for no limit")
+	progress := fs.Bool("progress", false, "write parse progress and the running scoreboard after every round to stdout as json lines, "+
+		"with -out - the scoreboard is the last line")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("give a demo file or - for stdin")
+	}
+
+	roster, err := loadRoster(*rosterFile)
+	if err != nil {
+		return err
+	}
+	opts := parseOptions{roster: roster}
+	if *progress {
+		opts.progress = ndjsonProgress(os.Stdout)
+	}
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var r io.Reader
+	demoName := "stdin.dem"
+	if fs.Arg(0) == "-" {
+		stdin, err := decompressStream(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer stdin.Close()
+
+		r = stdin
+		opts.matchDate = matchDate(*name, time.Now())
+	} else {
+		demo, err := fileDemoInput(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		file, err := demo.open()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r = file
+		demoName = demo.Name
+		opts.matchDate = matchDate(demo.Name, demo.ModTime)
+		if *name != "" {
+			opts.matchDate = matchDate(*name, demo.ModTime)
+		}
+	}
+
+	if *name != "" {
+		demoName = *name
+	}
+
+	scoreboard, _, err := parseDemo(ctx, r, demoName, opts)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		if *progress {
+			opts.progress(ProgressEvent{Type: "scoreboard", Demo: demoName, Progress: 1, Round: scoreboard.RoundsPlayed, Scoreboard: &scoreboard})
+			return nil
+		}
+		return scoreboard.writeJson(os.Stdout)
+	}
+
+	return writeFileAtomic(*out, scoreboard.writeJson)
+}
+
+// Holds back an io.EOF that comes with data until the next read. The parser panics when its first read returns
+// both, which gzip does for demos smaller than the parser's buffer
+type holdEOFReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (h *holdEOFReader) Read(p []byte) (int, error) {
+	if h.eof {
+		return 0, io.EOF
+	}
+
+	n, err := h.r.Read(p)
+	if err == io.EOF && n > 0 {
+		h.eof = true
+		err = nil
+	}
+	return n, err
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"slices"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/golang/geo/r3"
 	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
 	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/events"
 )
 
 func (p *PlayerScore) calculateADR(roundsPlayed int) {
@@ -31,6 +36,22 @@ func (p *PlayerScore) calculateKAST(roundsPlayed int) {
 	p.Kast = p.Kast / float64(roundsPlayed) * 100
 }
 
+// Approximation of HLTV rating 2.0 from KAST (percentage), kills, deaths and assists per round and ADR
+func performanceRating(kast float64, kpr float64, dpr float64, apr float64, adr float64) float64 {
+	impact := 2.13*kpr + 0.42*apr - 0.41
+	return 0.0073*kast + 0.3591*kpr - 0.5329*dpr + 0.2372*impact + 0.0032*adr + 0.1587
+}
+
+func (p *PlayerScore) calculateRating(roundsPlayed int) {
+	if roundsPlayed == 0 {
+		p.Rating = 0.0
+		return
+	}
+
+	rounds := float64(roundsPlayed)
+	p.Rating = performanceRating(p.Kast, float64(p.Kills)/rounds, float64(p.Deaths)/rounds, float64(p.Assists)/rounds, p.ADR)
+}
+
 func (rhs RoundHealths) updateDamager(p *common.Player, d *common.Player) {
 	if p == nil || d == nil {
 		return
@@ -63,10 +84,13 @@ func initializeRoundStats(sb Scoreboard, ctTS *common.TeamState, tTS *common.Tea
 	var rs RoundStats
 
 	rs.RoundHealths = initializeRoundHealths(sb.PlayerScores)
-	rs.KillsOnRound = make(map[uint64]int)
-	rs.Kast = make(map[uint64]bool)
-	rs.TimeOfDeath = make(map[uint64]time.Duration)
-	rs.Killers = make(map[uint64]uint64)
+	rs.kastRound = newKastRound()
+	rs.LastPositions = make(map[uint64]r3.Vector)
+	rs.Speeds = make(map[uint64]float64)
+	rs.FirstDamageDone = make(map[uint64]bool)
+	rs.FirstKillDone = make(map[uint64]bool)
+	rs.FirstHits = make(map[playerPair]time.Duration)
+	rs.Spotted = make(map[playerPair]time.Duration)
 
 	for _, p := range ctTS.Members() {
 		if p.IsAlive() {
@@ -80,7 +104,6 @@ func initializeRoundStats(sb Scoreboard, ctTS *common.TeamState, tTS *common.Tea
 		}
 	}
 
-	rs.EnemiesKilled = false
 	rs.RoundEnded = false
 	return rs
 }
@@ -96,9 +119,13 @@ func initializeRoundHealths(scores []PlayerScore) RoundHealths {
 	return rhs
 }
 
-func initializeScoreboard(gs dem.GameState) Scoreboard {
+func initializeScoreboard(gs dem.GameState, opts parseOptions) Scoreboard {
 	sb := Scoreboard{}
 
+	sb.roster = opts.roster
+	sb.gameState = gs
+	sb.MatchDate = opts.matchDate
+
 	sb.knifeRoundMatch = true
 
 	sb.TeamMemebers = make(map[int][]uint64)
@@ -110,17 +137,21 @@ func initializeScoreboard(gs dem.GameState) Scoreboard {
 	sb.TeamMemebers[ts.ID()] = []uint64{}
 
 	if len(sb.TeamMemebers[cts.ID()]) > 5 {
-		slog.Warn(fmt.Sprintf("Team %v (%v) player count %v. Count exceeded in initializeScoreboard.", cts.ID(), cts.ClanName(), len(sb.TeamMemebers[cts.ID()])))
+		sb.warn(WarnTeamSizeExceeded, sb.RoundsPlayed+1, fmt.Sprintf("Team %v (%v) player count %v. Count exceeded in initializeScoreboard.", cts.ID(), cts.ClanName(), len(sb.TeamMemebers[cts.ID()])))
 	}
 
 	if len(sb.TeamMemebers[ts.ID()]) > 5 {
-		slog.Warn(fmt.Sprintf("Team %v (%v) player count %v. Count exceeded in initializeScoreboard.", ts.ID(), ts.ClanName(), len(sb.TeamMemebers[ts.ID()])))
+		sb.warn(WarnTeamSizeExceeded, sb.RoundsPlayed+1, fmt.Sprintf("Team %v (%v) player count %v. Count exceeded in initializeScoreboard.", ts.ID(), ts.ClanName(), len(sb.TeamMemebers[ts.ID()])))
 	}
 
 	for _, player := range gs.Participants().Playing() {
 		sb.PlayerScores, _ = sb.getAddPlayerScore(player)
 	}
 
+	sb.KillMatrix = make(PlayerMatrix[int])
+	sb.DamageMatrix = make(PlayerMatrix[int])
+	sb.FlashMatrix = make(PlayerMatrix[float64])
+
 	sb.KDTypeBits = map[int]string{0: "teamkill", 1: "through smoke", 2: "wallbang", 3: "headshot", 4: "no scope", 5: "attacker blind", 6: "victim flashed", 7: "suicide"}
 
 	return sb
@@ -134,6 +165,11 @@ func (sb *Scoreboard) addResidualDamage(rhs RoundHealths) {
 					sb.PlayerScores[i].DamageDone += rh.MinHealthAboveZero
 				}
 			}
+
+			if sb.DamageMatrix[rh.PlayerWhoGetsTheDamage] == nil {
+				sb.DamageMatrix[rh.PlayerWhoGetsTheDamage] = make(map[uint64]int)
+			}
+			sb.DamageMatrix[rh.PlayerWhoGetsTheDamage][rh.SteamID] += rh.MinHealthAboveZero
 		}
 	}
 }
@@ -174,7 +210,7 @@ func (sb *Scoreboard) updatePostMatchStats() {
 	}
 
 	if len(zeroRoundPlayers) > 0 {
-		slog.Warn(fmt.Sprintf("Removing %v zeroround players", len(zeroRoundPlayers)))
+		sb.warn(WarnZeroRoundPlayers, 0, fmt.Sprintf("Removing %v zeroround players", len(zeroRoundPlayers)))
 		sb.PlayerScores = sb.PlayerScores[:len(sb.PlayerScores)-len(zeroRoundPlayers)]
 	}
 
@@ -186,10 +222,15 @@ func (sb *Scoreboard) updatePostMatchStats() {
 		return sb.PlayerScores[i].Kills > sb.PlayerScores[j].Kills
 	})
 
+	sb.updateClutchCounters()
+
 	// Calculate ADR and KAST for each player
 	for i := range sb.PlayerScores {
 		sb.PlayerScores[i].calculateADR(sb.RoundsPlayed)
 		sb.PlayerScores[i].calculateKAST(sb.RoundsPlayed)
+		sb.PlayerScores[i].calculateRating(sb.RoundsPlayed)
+		sb.PlayerScores[i].calculateAverageSpeed()
+		sb.PlayerScores[i].calculateTimings()
 	}
 
 }
@@ -207,10 +248,22 @@ func (sb *Scoreboard) getPlayerScore(p *common.Player) *PlayerScore {
 	dummy.DeathsByWeapon = make(map[string]int)
 	dummy.KillsByType = make(map[uint32]int)
 	dummy.DeathsByType = make(map[uint32]int)
+	dummy.DistanceByRound = make(map[int]float64)
+	dummy.TimingsByWeaponClass = make(map[string]*TimingStats)
 
 	return dummy
 }
 
+// Lookup by SteamID for scoreboards loaded from json, where player refs aren't available
+func (sb *Scoreboard) getPlayer(steamID uint64) *PlayerScore {
+	for i, ps := range sb.PlayerScores {
+		if ps.SteamID == steamID {
+			return &sb.PlayerScores[i]
+		}
+	}
+	return nil
+}
+
 func (sb *Scoreboard) getAddPlayerScore(p *common.Player) ([]PlayerScore, *PlayerScore) {
 	if id := getSteamID64(p); id > 0 {
 		for i, ps := range sb.PlayerScores {
@@ -249,44 +302,200 @@ func (sb *Scoreboard) getAddPlayerScore(p *common.Player) ([]PlayerScore, *Playe
 		playerRef: p,
 	})
 
+	sb.PlayerScores[len(sb.PlayerScores)-1].addAlias(p.Name)
+	sb.PlayerScores[len(sb.PlayerScores)-1].applyRoster(sb.roster, sb.MatchDate)
+
 	sb.PlayerScores[len(sb.PlayerScores)-1].KillsByWeapon = make(map[string]int)
 	sb.PlayerScores[len(sb.PlayerScores)-1].DeathsByWeapon = make(map[string]int)
 	sb.PlayerScores[len(sb.PlayerScores)-1].KillsByType = make(map[uint32]int)
 	sb.PlayerScores[len(sb.PlayerScores)-1].DeathsByType = make(map[uint32]int)
+	sb.PlayerScores[len(sb.PlayerScores)-1].DistanceByRound = make(map[int]float64)
+	sb.PlayerScores[len(sb.PlayerScores)-1].TimingsByWeaponClass = make(map[string]*TimingStats)
 
 	if len(sb.TeamMemebers[p.TeamState.ID()]) > 5 {
-		slog.Warn(fmt.Sprintf("Team %v (%v) player count %v. Added %v. Teammembers %v", p.TeamState.ID(), ClanName, len(sb.TeamMemebers[p.TeamState.ID()]), p.Name, sb.TeamMemebers[p.TeamState.ID()]))
+		sb.warn(WarnTeamSizeExceeded, sb.RoundsPlayed+1, fmt.Sprintf("Team %v (%v) player count %v. Added %v. Teammembers %v", p.TeamState.ID(), ClanName, len(sb.TeamMemebers[p.TeamState.ID()]), p.Name, sb.TeamMemebers[p.TeamState.ID()]))
 	}
 
 	return sb.PlayerScores, &sb.PlayerScores[len(sb.PlayerScores)-1]
 }
 
-func (sb *Scoreboard) saveJson(filename string, parsedDir string) error {
-	file, err := os.Create(parsedDir + filename)
+func (sb *Scoreboard) addPosition(eventType string, p *common.Player) {
+	if p == nil {
+		return
+	}
+
+	sb.addGrenadePosition(eventType, p, p.Position())
+}
+
+// Grenades land somewhere else than where the thrower is standing, so the position is given separately
+func (sb *Scoreboard) addGrenadePosition(eventType string, p *common.Player, pos r3.Vector) {
+	if p == nil || p.Name == "SourceTV" {
+		return
+	}
+
+	sb.Positions = append(sb.Positions, PositionEvent{
+		Type:    eventType,
+		SteamID: p.SteamID64,
+		Side:    int(p.Team),
+		Round:   sb.RoundsPlayed + 1,
+		X:       pos.X,
+		Y:       pos.Y,
+		Z:       pos.Z,
+	})
+}
+
+func (sb *Scoreboard) addRoundResult(e events.RoundEnd, cts *common.TeamState, ts *common.TeamState) {
+	rr := RoundResult{
+		Round:  sb.RoundsPlayed + 1,
+		Winner: int(e.Winner),
+		Reason: int(e.Reason),
+	}
+
+	for _, p := range cts.Members() {
+		rr.CTPlayers = append(rr.CTPlayers, p.SteamID64)
+	}
+	for _, p := range ts.Members() {
+		rr.TPlayers = append(rr.TPlayers, p.SteamID64)
+	}
+
+	sb.Rounds = append(sb.Rounds, rr)
+}
+
+func (sb *Scoreboard) addKillEvent(e events.Kill, killType uint32, timestamp time.Duration) {
+	weapon := ""
+	if e.Weapon != nil {
+		weapon = e.Weapon.String()
+	}
+
+	sb.Kills = append(sb.Kills, KillEvent{
+		Round:    sb.RoundsPlayed + 1,
+		Time:     timestamp.Seconds(),
+		Killer:   getSteamID64(e.Killer),
+		Victim:   getSteamID64(e.Victim),
+		Assister: getSteamID64(e.Assister),
+		Weapon:   weapon,
+		KillType: killType,
+		Side:     getPlayerTeam(e.Killer),
+	})
+}
+
+func loadScoreboardJson(path string) (Scoreboard, error) {
+	var sb Scoreboard
+
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return sb, err
 	}
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.Encode(sb)
+	err = json.NewDecoder(file).Decode(&sb)
+	return sb, err
+}
 
-	return nil
+// Reads every scoreboard from the parsed directory. Files that fail to load are logged and skipped.
+func loadParsedScoreboards(parsedDir string) ([]ParsedScoreboard, error) {
+	files, err := os.ReadDir(parsedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed []ParsedScoreboard
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), "_scoreboard.json") {
+			continue
+		}
+
+		sb, err := loadScoreboardJson(filepath.Join(parsedDir, file.Name()))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Skipping %v: %v", file.Name(), err))
+			continue
+		}
+
+		parsed = append(parsed, ParsedScoreboard{File: file.Name(), Scoreboard: sb})
+	}
+
+	// Parts of a merged match are already counted in the merged scoreboard
+	parts := make(map[string]bool)
+	for _, sb := range parsed {
+		for _, name := range sb.MergedFrom {
+			parts[name] = true
+		}
+	}
+	parsed = slices.DeleteFunc(parsed, func(sb ParsedScoreboard) bool { return parts[sb.File] })
+
+	return parsed, nil
+}
+
+func (sb *Scoreboard) saveJson(filename string, parsedDir string) error {
+	return writeFileAtomic(parsedDir+filename, sb.writeJson)
+}
+
+func (sb *Scoreboard) writeJson(w io.Writer) error {
+	return json.NewEncoder(w).Encode(sb)
 }
 
 type RoundStats struct {
-	KillsOnRound    map[uint64]int
-	CTAlive         int
-	TAlive          int
-	EnemiesKilled   bool
-	RoundHealths    RoundHealths
-	ClutchingPlayer *common.Player
-	Clutch1V1       *common.Player
-	EnemiesToClutch int
-	RoundEnded      bool              // Events after round end don't count towards clutches so, we need to track the round status
-	Killers         map[uint64]uint64 // Killers need to be tracked to check for trades
-	Kast            map[uint64]bool
-	TimeOfDeath     map[uint64]time.Duration
+	kastRound
+	CTAlive           int
+	TAlive            int
+	RoundHealths      RoundHealths
+	ClutchingPlayer   *common.Player
+	Clutch            *ClutchSituation
+	RoundEnded        bool // Events after round end don't count towards clutches so, we need to track the round status
+	FreezetimeEnded   bool // Movement is only tracked after freezetime
+	LastFrameTime     time.Duration
+	LastPositions     map[uint64]r3.Vector
+	Speeds            map[uint64]float64 // Latest horizontal speed, units per second
+	FreezetimeEndTime time.Duration
+	FirstDamageDone   map[uint64]bool
+	FirstKillDone     map[uint64]bool
+	FirstHits         map[playerPair]time.Duration // Attacker's first hit on the victim, for time to kill
+	Spotted           map[playerPair]time.Duration // When the observer saw the enemy, for reaction times
+}
+
+type ParsedScoreboard struct {
+	File string
+	Scoreboard
+}
+
+// Scoreboards parsed before match dates were saved get the date from the filename
+func (sb ParsedScoreboard) date() time.Time {
+	if !sb.MatchDate.IsZero() {
+		return sb.MatchDate
+	}
+	return matchDate(sb.File, time.Time{})
+}
+
+// Position of a kill, death or grenade landing. Side is the team number of the player (2 T, 3 CT)
+type PositionEvent struct {
+	Type    string  `json:"type"`
+	SteamID uint64  `json:"steam_id"`
+	Side    int     `json:"side"`
+	Round   int     `json:"round"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Z       float64 `json:"z"`
+}
+
+// KillType has the same bits as KillsByType. Time is seconds from the start of the demo
+type KillEvent struct {
+	Round    int     `json:"round"`
+	Time     float64 `json:"time"`
+	Killer   uint64  `json:"killer"`
+	Victim   uint64  `json:"victim"`
+	Assister uint64  `json:"assister"`
+	Weapon   string  `json:"weapon"`
+	KillType uint32  `json:"kill_type"`
+	Side     int     `json:"side"`
+}
+
+// Winner is the winning side (2 T, 3 CT). Reason is events.RoundEndReason
+type RoundResult struct {
+	Round     int      `json:"round"`
+	Winner    int      `json:"winner"`
+	Reason    int      `json:"reason"`
+	CTPlayers []uint64 `json:"ct_players"`
+	TPlayers  []uint64 `json:"t_players"`
 }
 
 type RoundHealths []RoundHealth
@@ -305,23 +514,73 @@ type KniferoundStats struct {
 }
 
 type Scoreboard struct {
-	PlayerScores    []PlayerScore    `json:"player_scores"`
-	RoundsPlayed    int              `json:"rounds_played"`
-	TeamNames       map[int]string   `json:"team_names"`
-	TeamMemebers    map[int][]uint64 `json:"team_members"`
-	WinnerTeamID    int              `json:"winner_team_id"`
-	WinnerTeam      string           `json:"winner_team"`
-	KDTypeBits      map[int]string   `json:"kd_type_bits"`
-	MaxRounds       int              `json:"max_rounds"`
-	MapName         string           `json:"map_name"`
+	PlayerScores    []PlayerScore         `json:"player_scores"`
+	RoundsPlayed    int                   `json:"rounds_played"`
+	TeamNames       map[int]string        `json:"team_names"`
+	TeamMemebers    map[int][]uint64      `json:"team_members"`
+	WinnerTeamID    int                   `json:"winner_team_id"`
+	WinnerTeam      string                `json:"winner_team"`
+	KDTypeBits      map[int]string        `json:"kd_type_bits"`
+	MaxRounds       int                   `json:"max_rounds"`
+	MapName         string                `json:"map_name"`
+	MatchDate       time.Time             `json:"match_date"`
+	MatchStartTick  int                   `json:"match_start_tick"`      // Server tick of the match start, used to recognize the same match in different demos
+	Warnings        []ParseWarning        `json:"warnings"`              // Problems that make the stats less reliable
+	MergedFrom      []string              `json:"merged_from,omitempty"` // Part files of a merged scoreboard, left out when loading the directory
+	Positions       []PositionEvent       `json:"positions"`
+	Rounds          []RoundResult         `json:"rounds"`
+	Kills           []KillEvent           `json:"kills"`
+	Clutches        []ClutchSituation     `json:"clutches"`
+	RoundSnapshots  []RoundSnapshot       `json:"round_snapshots"`
+	KillMatrix      PlayerMatrix[int]     `json:"kill_matrix"`   // killer -> victim -> kills
+	DamageMatrix    PlayerMatrix[int]     `json:"damage_matrix"` // attacker -> victim -> damage
+	FlashMatrix     PlayerMatrix[float64] `json:"flash_matrix"`  // flasher -> blinded player -> seconds blind
 	knifeRoundMatch bool
 	teamsSwapped    bool
+	roster          *Roster
+	gameState       dem.GameState // For the tick of warnings, nil for scoreboards loaded from json
+}
+
+// Data quality problem noticed while parsing. Consumers can leave out or flag matches by the codes
+type ParseWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Round   int    `json:"round"` // 0 when it's about the whole match
+	Tick    int    `json:"tick"`
+}
+
+const (
+	WarnIncompleteDemo    = "incomplete_demo"
+	WarnZeroRoundPlayers  = "zero_round_players"
+	WarnTeamSizeExceeded  = "team_size_exceeded"
+	WarnMissingMatchStart = "missing_match_start"
+	WarnInitializedEarly  = "initialized_before_match_start"
+	WarnMissingRounds     = "missing_rounds"     // Merged demos have a gap between them
+	WarnUnknownMaxRounds  = "unknown_max_rounds" // mp_maxrounds wasn't a number, defaultMaxRounds is used
+	WarnMissingCollectors = "missing_collectors" // Recomputed from the event cache, which doesn't have every stat group
+	WarnPartialTimings    = "partial_timings"    // Merged demos overlap, timings are only from the later demo
+)
+
+// mp_maxrounds of a regulation MR12 match
+const defaultMaxRounds = 24
+
+// Logs the warning and keeps it in the scoreboard
+func (sb *Scoreboard) warn(code string, round int, message string) {
+	slog.Warn(message)
+
+	w := ParseWarning{Code: code, Message: message, Round: round}
+	if sb.gameState != nil {
+		w.Tick = sb.gameState.IngameTick()
+	}
+	sb.Warnings = append(sb.Warnings, w)
 }
 
 type PlayerScore struct {
 	// General stats
 	SteamID            uint64         `json:"steam_id"`
 	Nickname           string         `json:"nickname"`
+	Aliases            []string       `json:"aliases"`               // In-game names used in the match
+	RosterName         bool           `json:"roster_name,omitempty"` // Nickname is from the roster file
 	Kills              int            `json:"kills"`
 	Assists            int            `json:"assists"`
 	Deaths             int            `json:"deaths"`
@@ -331,6 +590,7 @@ type PlayerScore struct {
 	TeamDamageDone     int            `json:"team_damage_done"`
 	TeamDamageReceived int            `json:"team_damage_received"`
 	ADR                float64        `json:"adr"`
+	Rating             float64        `json:"rating"`
 	Mvps               int            `json:"mvps"`
 	MoneySpentTotal    int            `json:"money_spent_total"`
 	KillsByWeapon      map[string]int `json:"kills_by_weapon"`
@@ -443,10 +703,27 @@ type PlayerScore struct {
 	ClutchV4Wins  int `json:"clutch_v4_wins"`
 	ClutchV5Count int `json:"clutch_v5_count"`
 	ClutchV5Wins  int `json:"clutch_v5_wins"`
+	ClutchLosses  int `json:"clutch_losses"`
+	ClutchSaves   int `json:"clutch_saves"`
 
 	KnifeRoundKills   int `json:"kniferound_kills"`
 	KnifeRoundAssists int `json:"kniferound_assists"`
 	KnifeRoundDeaths  int `json:"kniferound_deaths"`
+
+	// Movement stats. Distances are in game units, times in seconds
+	DistanceTravelled float64         `json:"distance_travelled"`
+	DistanceByRound   map[int]float64 `json:"distance_by_round"`
+	AverageSpeed      float64         `json:"average_speed"`
+	MaxSpeed          float64         `json:"max_speed"`
+	TimeAlive         float64         `json:"time_alive"`
+	TimeCrouched      float64         `json:"time_crouched"`
+	TimeAirborne      float64         `json:"time_airborne"`
+	ShotsWhileMoving  int             `json:"shots_while_moving"`
+	ShotsWhileStill   int             `json:"shots_while_still"`
+
+	// Timing stats, overall and by weapon class
+	Timings              TimingStats             `json:"timings"`
+	TimingsByWeaponClass map[string]*TimingStats `json:"timings_by_weapon_class"`
 	/////////////////////////////////////////////////
 
 	OnDeathDroppedUtilityValue       int
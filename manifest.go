@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StatusParsed      = "parsed"
+	StatusDuplicate   = "duplicate"
+	StatusFailed      = "failed"
+	StatusQuarantined = "quarantined" // Failed too many times and was moved to the quarantine directory
+)
+
+// Bump when a change in the parser changes the stats, so older scoreboards can be reparsed with --reparse-outdated
+const parserVersion = 3
+
+// Stat groups every parse writes
+var baseCollectors = []string{"scoreboard", "positions", "rounds", "kills", "clutches", "movement", "timings", "matrices", "round_snapshots", "warnings"}
+
+// Stat groups a parse with these options writes. A demo parsed without one of these is outdated too
+func (opts parseOptions) collectors() []string {
+	collectors := slices.Clone(baseCollectors)
+	if opts.roster != nil {
+		collectors = append(collectors, "roster")
+	}
+	if opts.eventsDir != "" {
+		collectors = append(collectors, "event_cache")
+	}
+	return collectors
+}
+
+// Manifest keeps track of parsed demos by content hash and match fingerprint, so the same match
+// under a different filename isn't parsed and counted twice
+type Manifest struct {
+	Demos map[string]*ManifestEntry `json:"demos"` // demo filename -> entry
+}
+
+type ManifestEntry struct {
+	Hash          string    `json:"hash"`
+	Fingerprint   string    `json:"fingerprint"`
+	Status        string    `json:"status"`
+	DuplicateOf   string    `json:"duplicate_of,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Failures      int       `json:"failures,omitempty"` // Failed runs in a row
+	ParserVersion int       `json:"parser_version"`     // 0 for demos parsed before the manifest
+	Collectors    []string  `json:"collectors"`
+	Outputs       []string  `json:"outputs"`
+	ParsedAt      time.Time `json:"parsed_at"`
+}
+
+func (e *ManifestEntry) outdated(collectors []string) bool {
+	switch e.Status {
+	case StatusDuplicate, StatusQuarantined:
+		return false
+	case StatusFailed:
+		return true
+	}
+	if e.ParserVersion < parserVersion {
+		return true
+	}
+	for _, c := range collectors {
+		if !slices.Contains(e.Collectors, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	manifest := &Manifest{Demos: make(map[string]*ManifestEntry)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest %v: %w", path, err)
+	}
+	if manifest.Demos == nil {
+		manifest.Demos = make(map[string]*ManifestEntry)
+	}
+
+	return manifest, nil
+}
+
+func (m *Manifest) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Earliest parsed demo other than the given one with a matching value
+func (m *Manifest) findParsed(demo string, matches func(e *ManifestEntry) bool) string {
+	var names []string
+	for name, e := range m.Demos {
+		if name != demo && e.Status == StatusParsed && matches(e) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+func (m *Manifest) byHash(demo string, hash string) string {
+	return m.findParsed(demo, func(e *ManifestEntry) bool { return e.Hash == hash })
+}
+
+func (m *Manifest) byFingerprint(demo string, fingerprint string) string {
+	return m.findParsed(demo, func(e *ManifestEntry) bool { return e.Fingerprint == fingerprint })
+}
+
+// Fingerprint of the match itself: the same match recorded or compressed differently gets the same fingerprint
+func (sb *Scoreboard) fingerprint() string {
+	var players []uint64
+	for _, ps := range sb.PlayerScores {
+		players = append(players, ps.SteamID)
+	}
+	slices.Sort(players)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v|%v|", sb.MapName, sb.MatchStartTick)
+	for _, id := range players {
+		b.WriteString(strconv.FormatUint(id, 10) + ",")
+	}
+	b.WriteString("|")
+	for _, rr := range sb.Rounds {
+		fmt.Fprintf(&b, "%v:%v:%v,", rr.Round, rr.Winner, rr.Reason)
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Failures are counted while the demo stays the same
+func (m *Manifest) recordFailed(demo string, hash string, err error) {
+	failures := 1
+	if prev := m.Demos[demo]; prev != nil && prev.Status == StatusFailed && prev.Hash == hash {
+		failures = prev.Failures + 1
+	}
+
+	m.Demos[demo] = &ManifestEntry{
+		Hash:          hash,
+		Status:        StatusFailed,
+		Error:         err.Error(),
+		Failures:      failures,
+		ParserVersion: parserVersion,
+		ParsedAt:      time.Now(),
+	}
+}
+
+// Checks a freshly parsed scoreboard against the manifest. Duplicates have their scoreboard removed so
+// they aren't counted in reports. Version is 0 and collectors nil when it isn't known how the scoreboard was parsed
+func (m *Manifest) recordParsed(demo string, hash string, parsedDir string, version int, collectors []string) error {
+	scoreboardFile := strings.TrimSuffix(demo, ".dem") + ".dem_scoreboard.json"
+
+	sb, err := loadScoreboardJson(parsedDir + scoreboardFile)
+	if err != nil {
+		return err
+	}
+
+	entry := &ManifestEntry{
+		Hash:          hash,
+		Fingerprint:   sb.fingerprint(),
+		Status:        StatusParsed,
+		ParserVersion: version,
+		Outputs:       []string{parsedDir + scoreboardFile},
+	}
+	if version > 0 {
+		entry.Collectors = collectors
+		entry.ParsedAt = time.Now()
+	}
+	m.Demos[demo] = entry
+
+	if original := m.byFingerprint(demo, entry.Fingerprint); original != "" {
+		slog.Warn(fmt.Sprintf("%v is the same match as %v, skipping it", demo, original))
+		entry.Status = StatusDuplicate
+		entry.DuplicateOf = original
+		entry.Outputs = nil
+		return os.Remove(parsedDir + scoreboardFile)
+	}
+
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Cumulative player counters at the end of a round, keyed by json field name. Only non-zero values are stored.
+// With these a scoreboard of a partial demo can be cut at any round when merging.
+type RoundSnapshot struct {
+	Round   int                           `json:"round"`
+	Players map[uint64]map[string]float64 `json:"players"`
+	Damage  PlayerMatrix[int]             `json:"damage"` // Damage and flash matrices so far
+	Flash   PlayerMatrix[float64]         `json:"flash"`
+}
+
+// Game state gives these as match totals, so after a demo restart they already include the earlier rounds
+var absoluteCounters = []string{"kills", "assists", "deaths", "mvps", "money_spent_total", "team_rounds", "team_id"}
+
+// Calculated after the match, not counted
+var derivedCounters = []string{"adr", "rating", "average_speed"}
+
+func counterName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func playerCounters(ps PlayerScore) map[string]float64 {
+	counters := make(map[string]float64)
+
+	v := reflect.ValueOf(ps)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() || slices.Contains(derivedCounters, counterName(f)) {
+			continue
+		}
+
+		switch f.Type.Kind() {
+		case reflect.Int:
+			if n := v.Field(i).Int(); n != 0 {
+				counters[counterName(f)] = float64(n)
+			}
+		case reflect.Float64:
+			if n := v.Field(i).Float(); n != 0 {
+				counters[counterName(f)] = n
+			}
+		}
+	}
+
+	return counters
+}
+
+func (ps *PlayerScore) setCounters(counters map[string]float64) {
+	v := reflect.ValueOf(ps).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		switch f.Type.Kind() {
+		case reflect.Int:
+			v.Field(i).SetInt(int64(counters[counterName(f)]))
+		case reflect.Float64:
+			v.Field(i).SetFloat(counters[counterName(f)])
+		}
+	}
+}
+
+func (sb *Scoreboard) addRoundSnapshot() {
+	if len(sb.Rounds) == 0 {
+		return
+	}
+
+	snapshot := RoundSnapshot{
+		Round:   sb.Rounds[len(sb.Rounds)-1].Round,
+		Players: make(map[uint64]map[string]float64),
+		Damage:  sumMatrices(sb.DamageMatrix, nil),
+		Flash:   sumMatrices(sb.FlashMatrix, nil),
+	}
+	for _, ps := range sb.PlayerScores {
+		snapshot.Players[ps.SteamID] = playerCounters(ps)
+	}
+
+	sb.RoundSnapshots = append(sb.RoundSnapshots, snapshot)
+}
+
+// Latest snapshot before the round, empty if the round is the first one
+func (sb *Scoreboard) snapshotBefore(round int) RoundSnapshot {
+	snapshot := RoundSnapshot{Players: make(map[uint64]map[string]float64)}
+	for _, s := range sb.RoundSnapshots {
+		if s.Round < round {
+			snapshot = s
+		}
+	}
+	return snapshot
+}
+
+func combineCounters(earlier map[string]float64, later map[string]float64) map[string]float64 {
+	combined := make(map[string]float64)
+	for name, n := range earlier {
+		combined[name] = n
+	}
+
+	for name, n := range later {
+		switch {
+		case slices.Contains(absoluteCounters, name):
+			combined[name] = n
+		case name == "max_speed":
+			combined[name] = max(combined[name], n)
+		default:
+			combined[name] += n
+		}
+	}
+
+	return combined
+}
+
+func mergeCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("out", "", "name of the merged scoreboard in the parsed directory, default is the first file with _merged")
+	force := fs.Bool("force", false, "merge even if the map or players don't match")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		return fmt.Errorf("give at least two scoreboard files from %v to merge", parsedDir)
+	}
+
+	var parts []ParsedScoreboard
+	for _, name := range fs.Args() {
+		path := name
+		if _, err := os.Stat(path); err != nil {
+			path = filepath.Join(parsedDir, name)
+		}
+
+		sb, err := loadScoreboardJson(path)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, ParsedScoreboard{File: filepath.Base(path), Scoreboard: sb})
+	}
+
+	merged, err := mergeScoreboards(parts, *force)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(parts[0].File, "_scoreboard.json") + "_merged_scoreboard.json"
+	}
+	if slices.Contains(merged.MergedFrom, *out) {
+		return fmt.Errorf("%v is one of the parts, give another name with -out", *out)
+	}
+
+	if err := merged.saveJson(*out, parsedDir); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Merged %v scoreboards with %v rounds into %v", len(parts), merged.RoundsPlayed, *out))
+
+	return nil
+}
+
+// Parts are put in round order. When rounds overlap, the later demo wins: after a restart or a backup restore
+// the rounds in the later demo are the ones that counted
+func mergeScoreboards(parts []ParsedScoreboard, force bool) (Scoreboard, error) {
+	for _, part := range parts {
+		if len(part.Rounds) == 0 || len(part.RoundSnapshots) == 0 {
+			return Scoreboard{}, fmt.Errorf("%v has no round results or snapshots, parse the demo again before merging", part.File)
+		}
+		if last := part.RoundSnapshots[len(part.RoundSnapshots)-1]; last.Damage == nil && len(part.DamageMatrix) > 0 {
+			return Scoreboard{}, fmt.Errorf("%v has no matrices in its snapshots, parse the demo again before merging", part.File)
+		}
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].Rounds[0].Round < parts[j].Rounds[0].Round
+	})
+
+	if !force {
+		for _, part := range parts[1:] {
+			if part.MapName != parts[0].MapName {
+				return Scoreboard{}, fmt.Errorf("%v is on %v but %v is on %v, use -force to merge anyway", part.File, part.MapName, parts[0].File, parts[0].MapName)
+			}
+			if rosterKey(part.Scoreboard) != rosterKey(parts[0].Scoreboard) {
+				slog.Warn(fmt.Sprintf("Players in %v and %v differ", part.File, parts[0].File))
+			}
+		}
+	}
+
+	merged := parts[0].Scoreboard
+	for _, part := range parts[1:] {
+		merged = mergeTwo(merged, part.Scoreboard)
+	}
+
+	// Parts of merged parts too, so merging a merged scoreboard again leaves all of them out
+	merged.MergedFrom = nil
+	for _, part := range parts {
+		merged.MergedFrom = append(merged.MergedFrom, part.MergedFrom...)
+		merged.MergedFrom = append(merged.MergedFrom, part.File)
+	}
+
+	return merged, nil
+}
+
+func mergeTwo(a Scoreboard, b Scoreboard) Scoreboard {
+	cut := b.Rounds[0].Round
+	base := a.snapshotBefore(cut)
+
+	merged := b
+	merged.Warnings = append(slices.Clone(a.Warnings), b.Warnings...)
+
+	overlap := false
+	if last := a.Rounds[len(a.Rounds)-1].Round; last < cut-1 {
+		merged.warn(WarnMissingRounds, last+1, fmt.Sprintf("Rounds %v-%v are missing between the demos", last+1, cut-1))
+	} else if last >= cut {
+		slog.Info(fmt.Sprintf("Rounds %v-%v overlap, using the later demo for them", cut, last))
+		overlap = true
+	}
+
+	merged.MatchDate = a.MatchDate
+	merged.Rounds = append(filterRounds(a.Rounds, cut), b.Rounds...)
+	merged.Kills = append(filterRounds(a.Kills, cut), b.Kills...)
+	merged.Positions = append(filterRounds(a.Positions, cut), b.Positions...)
+	merged.Clutches = append(filterRounds(a.Clutches, cut), b.Clutches...)
+
+	// Later snapshots are cumulative over both demos so a third part can be merged the same way
+	merged.RoundSnapshots = filterRounds(a.RoundSnapshots, cut)
+	for _, s := range b.RoundSnapshots {
+		combined := RoundSnapshot{
+			Round:   s.Round,
+			Players: make(map[uint64]map[string]float64),
+			Damage:  sumMatrices(base.Damage, s.Damage),
+			Flash:   sumMatrices(base.Flash, s.Flash),
+		}
+		for id, counters := range base.Players {
+			combined.Players[id] = counters
+		}
+		for id, counters := range s.Players {
+			combined.Players[id] = combineCounters(base.Players[id], counters)
+		}
+		merged.RoundSnapshots = append(merged.RoundSnapshots, combined)
+	}
+
+	final := merged.RoundSnapshots[len(merged.RoundSnapshots)-1]
+
+	// Like the counters, matrices are the first demo's up to the cut and the later demo's after it
+	merged.KillMatrix = make(PlayerMatrix[int])
+	merged.DamageMatrix = sumMatrices(base.Damage, b.DamageMatrix)
+	merged.FlashMatrix = sumMatrices(base.Flash, b.FlashMatrix)
+
+	players := make(map[uint64]PlayerScore)
+	var order []uint64
+	for i, sb := range []Scoreboard{a, b} {
+		for _, ps := range sb.PlayerScores {
+			if ps.DistanceByRound == nil {
+				ps.DistanceByRound = make(map[int]float64)
+			}
+			// Timings are match totals without the rounds, so the overlapping rounds can't be taken out of them
+			if ps.TimingsByWeaponClass == nil || (i == 0 && overlap) {
+				ps.TimingsByWeaponClass = make(map[string]*TimingStats)
+			}
+			if i == 0 && overlap {
+				ps.Timings = TimingStats{}
+			}
+
+			if previous, ok := players[ps.SteamID]; ok {
+				for _, alias := range previous.Aliases {
+					ps.addAlias(alias)
+				}
+				ps.Timings = mergeTimings(previous.Timings, ps.Timings)
+				for class, t := range previous.TimingsByWeaponClass {
+					if ps.TimingsByWeaponClass[class] == nil {
+						ps.TimingsByWeaponClass[class] = &TimingStats{}
+					}
+					*ps.TimingsByWeaponClass[class] = mergeTimings(*t, *ps.TimingsByWeaponClass[class])
+				}
+				for round, d := range previous.DistanceByRound {
+					if round < cut {
+						ps.DistanceByRound[round] = d
+					}
+				}
+			} else {
+				order = append(order, ps.SteamID)
+			}
+			players[ps.SteamID] = ps
+		}
+	}
+
+	merged.PlayerScores = nil
+	for _, id := range order {
+		ps := players[id]
+		ps.setCounters(final.Players[id])
+		ps.KillsByWeapon = make(map[string]int)
+		ps.DeathsByWeapon = make(map[string]int)
+		ps.KillsByType = make(map[uint32]int)
+		ps.DeathsByType = make(map[uint32]int)
+		merged.PlayerScores = append(merged.PlayerScores, ps)
+	}
+
+	for _, k := range merged.Kills {
+		merged.KillMatrix.addIDs(k.Killer, k.Victim, 1)
+		if killer := merged.getPlayer(k.Killer); killer != nil {
+			killer.KillsByType[k.KillType] += 1
+			if k.Weapon != "" {
+				killer.KillsByWeapon[k.Weapon] += 1
+			}
+		}
+		if victim := merged.getPlayer(k.Victim); victim != nil {
+			victim.DeathsByType[k.KillType] += 1
+			if k.Weapon != "" {
+				victim.DeathsByWeapon[k.Weapon] += 1
+			}
+		}
+	}
+
+	merged.RoundsPlayed = merged.Rounds[len(merged.Rounds)-1].Round
+
+	if overlap {
+		merged.warn(WarnPartialTimings, cut, fmt.Sprintf("Rounds overlap, timings are only from round %v on", cut))
+	}
+
+	// updatePostMatchStats calculates timings from the samples, which loaded scoreboards don't have
+	timings := make(map[uint64]PlayerScore)
+	for _, ps := range merged.PlayerScores {
+		timings[ps.SteamID] = ps
+	}
+
+	merged.updatePostMatchStats()
+
+	for i, ps := range merged.PlayerScores {
+		merged.PlayerScores[i].Timings = timings[ps.SteamID].Timings
+		merged.PlayerScores[i].TimingsByWeaponClass = timings[ps.SteamID].TimingsByWeaponClass
+	}
+
+	return merged
+}
+
+type roundEvent interface {
+	RoundResult | KillEvent | PositionEvent | ClutchSituation | RoundSnapshot
+}
+
+func eventRound[T roundEvent](e T) int {
+	switch e := any(e).(type) {
+	case RoundResult:
+		return e.Round
+	case KillEvent:
+		return e.Round
+	case PositionEvent:
+		return e.Round
+	case ClutchSituation:
+		return e.Round
+	case RoundSnapshot:
+		return e.Round
+	}
+	return 0
+}
+
+// Events of rounds before the cut
+func filterRounds[T roundEvent](events []T, cut int) []T {
+	var kept []T
+	for _, e := range events {
+		if eventRound(e) < cut {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func sumMatrices[T int | float64](a PlayerMatrix[T], b PlayerMatrix[T]) PlayerMatrix[T] {
+	sum := make(PlayerMatrix[T])
+	for _, m := range []PlayerMatrix[T]{a, b} {
+		for from, row := range m {
+			if sum[from] == nil {
+				sum[from] = make(map[uint64]T)
+			}
+			for to, v := range row {
+				sum[from][to] += v
+			}
+		}
+	}
+	return sum
+}
+
+// Averages are weighted by sample counts. For the reaction time median this is an approximation
+func mergeTimings(a TimingStats, b TimingStats) TimingStats {
+	weighted := func(x float64, nx int, y float64, ny int) float64 {
+		if nx+ny == 0 {
+			return 0
+		}
+		return (x*float64(nx) + y*float64(ny)) / float64(nx+ny)
+	}
+
+	return TimingStats{
+		TimeToFirstDamage:   weighted(a.TimeToFirstDamage, a.FirstDamageSamples, b.TimeToFirstDamage, b.FirstDamageSamples),
+		TimeToFirstKill:     weighted(a.TimeToFirstKill, a.FirstKillSamples, b.TimeToFirstKill, b.FirstKillSamples),
+		TimeToKill:          weighted(a.TimeToKill, a.TimeToKillSamples, b.TimeToKill, b.TimeToKillSamples),
+		ReactionTime:        weighted(a.ReactionTime, a.ReactionTimeSamples, b.ReactionTime, b.ReactionTimeSamples),
+		FirstDamageSamples:  a.FirstDamageSamples + b.FirstDamageSamples,
+		FirstKillSamples:    a.FirstKillSamples + b.FirstKillSamples,
+		TimeToKillSamples:   a.TimeToKillSamples + b.TimeToKillSamples,
+		ReactionTimeSamples: a.ReactionTimeSamples + b.ReactionTimeSamples,
+	}
+}
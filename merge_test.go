@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Scoreboard of a demo with rounds first..last where the player gets a kill and 100 damage every round. Kills come
+// from the game state so they count from the start of the match, damage only from the start of the demo
+func partScoreboard(first int, last int) Scoreboard {
+	sb := Scoreboard{
+		MapName:      "de_test",
+		MatchDate:    time.Date(2026, 1, 2, 18, 0, 0, 0, time.UTC),
+		PlayerScores: []PlayerScore{{SteamID: 1, Nickname: "player"}},
+	}
+	for round := first; round <= last; round++ {
+		sb.PlayerScores[0].Kills = round
+		sb.PlayerScores[0].DamageDone += 100
+		sb.PlayerScores[0].PlayedRounds += 1
+		sb.Rounds = append(sb.Rounds, RoundResult{Round: round, Winner: 2})
+		sb.RoundsPlayed = round
+		sb.addRoundSnapshot()
+	}
+	return sb
+}
+
+func TestMergeAggregate(t *testing.T) {
+	parsedDir := t.TempDir() + "/"
+	a, b := partScoreboard(1, 10), partScoreboard(8, 12)
+	if err := a.saveJson("a_scoreboard.json", parsedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.saveJson("b_scoreboard.json", parsedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergeCommand([]string{"a_scoreboard.json", "b_scoreboard.json"}, parsedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the merged scoreboard is loaded, the parts are in it
+	parsed, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || parsed[0].File != "a_merged_scoreboard.json" {
+		var files []string
+		for _, sb := range parsed {
+			files = append(files, sb.File)
+		}
+		t.Fatalf("loaded %v, want only a_merged_scoreboard.json", files)
+	}
+
+	// Rounds 8-10 are from the later demo, so 7 rounds of damage from a and 5 from b
+	careers := aggregateCareers(parsed)
+	if len(careers) != 1 {
+		t.Fatalf("got %v careers, want 1", len(careers))
+	}
+	c := careers[0]
+	if c.MatchesPlayed != 1 || c.Totals.Kills != 12 || c.Totals.DamageDone != 1200 {
+		t.Errorf("got %v matches, %v kills and %v damage, want 1, 12 and 1200", c.MatchesPlayed, c.Totals.Kills, c.Totals.DamageDone)
+	}
+
+	index, err := updateQueryIndex(parsedDir+"query_index.json", parsedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := index.matchFiles(); !slices.Equal(files, []string{"a_merged_scoreboard.json"}) {
+		t.Errorf("query uses %v, want only a_merged_scoreboard.json", files)
+	}
+}
+
+func TestMergeTimings(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   int // First round of the later demo
+		samples int
+		warning bool
+	}{
+		{"consecutive", 11, 15, false},
+		{"overlapping", 8, 5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := partScoreboard(1, 10), partScoreboard(tt.first, tt.first+4)
+			a.PlayerScores[0].Timings = TimingStats{ReactionTime: 0.5, ReactionTimeSamples: 10}
+			b.PlayerScores[0].Timings = TimingStats{ReactionTime: 0.2, ReactionTimeSamples: 5}
+
+			merged, err := mergeScoreboards([]ParsedScoreboard{{File: "a", Scoreboard: a}, {File: "b", Scoreboard: b}}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := merged.PlayerScores[0].Timings.ReactionTimeSamples; got != tt.samples {
+				t.Errorf("got %v reaction time samples, want %v", got, tt.samples)
+			}
+			warned := slices.ContainsFunc(merged.Warnings, func(w ParseWarning) bool { return w.Code == WarnPartialTimings })
+			if warned != tt.warning {
+				t.Errorf("warnings are %+v, want %v only when the rounds overlap", merged.Warnings, WarnPartialTimings)
+			}
+		})
+	}
+}
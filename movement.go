@@ -0,0 +1,77 @@
+package main
+
+import (
+	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+const (
+	movingSpeedThreshold = 10.0   // Units per second. Below this the player counts as standing still when shooting
+	maxVelocity          = 3500.0 // sv_maxvelocity, the engine caps each axis of the velocity to this
+	teleportMargin       = 2.0    // Covers all three axes at the cap and uneven frame times
+)
+
+// Position jumps bigger than a player can move in dt are respawns or teleports, not movement. At 64 tick this is
+// about 110 units a frame, a fixed distance would either let teleports through or drop movement when frames are skipped
+func isTeleport(distance float64, dt float64) bool {
+	return distance > maxVelocity*teleportMargin*dt
+}
+
+// Called once per frame for every player alive during the round (after freezetime)
+func (ps *PlayerScore) updateMovement(p *common.Player, rs *RoundStats, dt float64, round int) {
+	ps.TimeAlive += dt
+
+	if p.IsDucking() {
+		ps.TimeCrouched += dt
+	}
+
+	if p.IsAirborne() {
+		ps.TimeAirborne += dt
+	}
+
+	pos := p.Position()
+	last, ok := rs.LastPositions[p.SteamID64]
+	rs.LastPositions[p.SteamID64] = pos
+
+	if !ok || dt <= 0 {
+		return
+	}
+
+	distance := pos.Sub(last).Norm()
+	if isTeleport(distance, dt) {
+		return
+	}
+
+	ps.DistanceTravelled += distance
+	ps.DistanceByRound[round] += distance
+
+	// Velocity() of the parser is deprecated, so speed is calculated from the sampled positions. Vertical movement is left out
+	horizontal := pos.Sub(last)
+	horizontal.Z = 0
+	speed := horizontal.Norm() / dt
+
+	rs.Speeds[p.SteamID64] = speed
+	if speed > ps.MaxSpeed {
+		ps.MaxSpeed = speed
+	}
+}
+
+func (ps *PlayerScore) updateShotMovement(p *common.Player, rs RoundStats) {
+	if p == nil {
+		return
+	}
+
+	if rs.Speeds[p.SteamID64] > movingSpeedThreshold {
+		ps.ShotsWhileMoving += 1
+	} else {
+		ps.ShotsWhileStill += 1
+	}
+}
+
+func (ps *PlayerScore) calculateAverageSpeed() {
+	if ps.TimeAlive == 0 {
+		ps.AverageSpeed = 0.0
+		return
+	}
+
+	ps.AverageSpeed = ps.DistanceTravelled / ps.TimeAlive
+}
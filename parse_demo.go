@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"reflect"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync" // Import sync package for mutex
+	"syscall"
 	"time"
 
 	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
@@ -25,6 +31,129 @@ func main() {
 
 	demosDir := "data/demos/"
 	parsedDir := "data/parsed/"
+	rosterFile := "data/roster.json"
+	manifestFile := "data/manifest.json"
+
+	eventsDir := "data/events/"
+	quarantineDir := "data/quarantine/"
+	reportDir := "data/reports/"
+
+	// The first interrupt stops parsing cleanly, demos parsed so far keep their outputs. A second one quits right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		slog.Warn("Stopping, interrupt again to quit right away")
+	}()
+
+	// Without a command the demos are parsed
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		fs := flag.NewFlagSet("demoparser", flag.ExitOnError)
+		reparseOutdated := fs.Bool("reparse-outdated", false, "parse again demos parsed with an older parser version")
+		cacheEvents := fs.Bool("cache-events", false, "write the events of parsed demos to "+eventsDir+" for recompute")
+		timeout := fs.Duration("timeout", 10*time.Minute, "give up on a demo that takes longer than this to parse, 0 for no limit")
+		quarantineAfter := fs.Int("quarantine-after", 3, "move demos that failed this many runs in a row to "+quarantineDir+", 0 to never")
+		progress := fs.Bool("progress", false, "write parse progress and the running scoreboard after every round to stdout as json lines")
+		fs.Parse(os.Args[1:])
+
+		roster, err := loadRoster(rosterFile)
+		if err != nil {
+			slog.Error(fmt.Sprint(err))
+			os.Exit(1)
+		}
+
+		opts := parseOptions{
+			roster:          roster,
+			reparseOutdated: *reparseOutdated,
+			timeout:         *timeout,
+			quarantineDir:   quarantineDir,
+			quarantineAfter: *quarantineAfter,
+		}
+		if *cacheEvents {
+			opts.eventsDir = eventsDir
+		}
+		if *progress {
+			opts.progress = ndjsonProgress(os.Stdout)
+		}
+
+		parseAllDemos(ctx, demosDir, parsedDir, manifestFile, reportDir, opts)
+		return
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "heatmap":
+		err = heatmapCommand(os.Args[2:], parsedDir)
+	case "duel":
+		err = duelCommand(os.Args[2:], parsedDir)
+	case "aggregate":
+		err = aggregateCommand(os.Args[2:], parsedDir)
+	case "rating":
+		err = ratingCommand(os.Args[2:], parsedDir)
+	case "teams":
+		err = teamReportCommand(os.Args[2:], parsedDir)
+	case "query":
+		err = queryCommand(os.Args[2:], parsedDir)
+	case "series":
+		err = seriesCommand(os.Args[2:], parsedDir)
+	case "merge":
+		err = mergeCommand(os.Args[2:], parsedDir)
+	case "recompute":
+		err = recomputeCommand(os.Args[2:], parsedDir)
+	case "parse":
+		err = parseCommand(ctx, os.Args[2:], parsedDir)
+	case "watch":
+		err = watchCommand(ctx, os.Args[2:], parsedDir)
+	case "serve":
+		err = serveCommand(ctx, os.Args[2:], parsedDir)
+	case "broadcast":
+		err = broadcastCommand(ctx, os.Args[2:], parsedDir)
+	default:
+		slog.Error(fmt.Sprintf("Unknown command %v", os.Args[1]))
+		os.Exit(2)
+	}
+
+	if err != nil {
+		slog.Error(fmt.Sprint(err))
+		os.Exit(1)
+	}
+}
+
+// Parses the demos that aren't parsed yet and writes a report of the run to reportDir
+func parseAllDemos(ctx context.Context, demosDir string, parsedDir string, manifestFile string, reportDir string, opts parseOptions) {
+	started := time.Now()
+
+	// Read the demos directory
+	demos, err := listDemoInputs(demosDir)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error reading demos directory: %s", err))
+	}
+
+	results := parseDemos(ctx, demos, parsedDir, manifestFile, opts)
+
+	if err := writeRunReport(results, started, reportDir); err != nil {
+		slog.Error(fmt.Sprintf("Error writing run report: %v", err))
+	}
+}
+
+const (
+	StatusSkipped   = "skipped"   // Demo was already parsed and wasn't parsed again
+	StatusCancelled = "cancelled" // Run was stopped while parsing the demo, it isn't recorded in the manifest
+)
+
+// Outcome of one demo in a run. Status is one of the manifest statuses, skipped or cancelled
+type parseResult struct {
+	Demo     string
+	Status   string
+	Err      error
+	Duration time.Duration
+	Rounds   int
+	Warnings []ParseWarning
+	Outputs  []string
+}
+
+func parseDemos(ctx context.Context, demos []demoInput, parsedDir string, manifestFile string, opts parseOptions) []parseResult {
+	var results []parseResult
 
 	// Ensure the parsed directory exists, create it if it doesn't
 	if _, err := os.Stat(parsedDir); os.IsNotExist(err) {
@@ -48,58 +177,224 @@ func main() {
 		parsedMap[name] = true
 	}
 
-	// Read the demos directory
-	demos, err := os.ReadDir(demosDir)
+	manifest, err := loadManifest(manifestFile)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error reading demos directory: %s", err))
+		slog.Error(fmt.Sprint(err))
+		return results
 	}
 
 	// Loop through the demos directory, and parse demos
-	for _, demo := range demos {
-		if strings.HasSuffix(demo.Name(), ".dem") {
-			filename := strings.TrimSuffix(demo.Name(), ".dem")
-			// Check if the demo hasn't been parsed already
-
-			if _, exists := parsedMap[filename]; !exists {
-				if true { //!strings.Contains(filename, "2024-01") && !strings.Contains(filename, "_-1") {
-					err := parseSingleDemo(demosDir, demo.Name(), parsedDir)
-
-					if err != nil {
-						slog.Error(fmt.Sprintf("%v parsing failed", demo.Name()))
-						slog.Error(fmt.Sprint(err))
+	for i, demo := range demos {
+		if ctx.Err() != nil {
+			slog.Warn(fmt.Sprintf("Stopped, %v demos weren't checked", len(demos)-i))
+			break
+		}
+
+		filename := strings.TrimSuffix(demo.Name, ".dem")
+		entry := manifest.Demos[demo.Name]
+
+		if entry != nil && (entry.Status == StatusDuplicate || entry.Status == StatusQuarantined) {
+			results = append(results, parseResult{Demo: demo.Name, Status: StatusSkipped})
+			continue
+		}
+
+		// Demos parsed before the manifest existed are added to it, which also catches duplicates among them
+		if _, exists := parsedMap[filename]; exists {
+			if entry == nil {
+				if err := checkParsedDemo(manifest, demo, parsedDir); err != nil {
+					slog.Warn(fmt.Sprintf("Couldn't add %v to the manifest: %v", demo.Name, err))
+				}
+				if err := manifest.save(manifestFile); err != nil {
+					slog.Error(fmt.Sprintf("Error saving manifest: %v", err))
+				}
+				entry = manifest.Demos[demo.Name]
+			}
+
+			if !opts.reparseOutdated || entry == nil || !entry.outdated(opts.collectors()) {
+				results = append(results, parseResult{Demo: demo.Name, Status: StatusSkipped})
+				continue
+			}
+			slog.Info(fmt.Sprintf("%v was parsed with parser version %v, parsing it again", demo.Name, entry.ParserVersion))
+		}
+
+		hash, err := demo.hash()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error reading demo file %v: %v", demo, err))
+			results = append(results, parseResult{Demo: demo.Name, Status: StatusFailed, Err: err})
+			continue
+		}
+
+		if original := manifest.byHash(demo.Name, hash); original != "" {
+			slog.Warn(fmt.Sprintf("%v has the same content as %v, skipping it", demo, original))
+			manifest.Demos[demo.Name] = &ManifestEntry{Hash: hash, Status: StatusDuplicate, DuplicateOf: original}
+			if err := manifest.save(manifestFile); err != nil {
+				slog.Error(fmt.Sprintf("Error saving manifest: %v", err))
+			}
+			results = append(results, parseResult{Demo: demo.Name, Status: StatusDuplicate})
+			continue
+		}
+
+		if true { //!strings.Contains(filename, "2024-01") && !strings.Contains(filename, "_-1") {
+			start := time.Now()
+			scoreboard, err := parseSingleDemo(ctx, demo, parsedDir, opts)
+			result := parseResult{
+				Demo:     demo.Name,
+				Status:   StatusParsed,
+				Err:      err,
+				Duration: time.Since(start),
+				Rounds:   scoreboard.RoundsPlayed,
+				Warnings: scoreboard.Warnings,
+			}
+
+			if err != nil && ctx.Err() != nil {
+				// Interrupted, not the demo's fault, so it's parsed again on the next run
+				slog.Warn(fmt.Sprintf("%v parsing was cancelled", demo.Name))
+				result.Status = StatusCancelled
+				results = append(results, result)
+				break
+			} else if err != nil {
+				result.Status = StatusFailed
+				slog.Error(fmt.Sprintf("%v parsing failed", demo.Name))
+				slog.Error(fmt.Sprint(err))
+				manifest.recordFailed(demo.Name, hash, err)
+
+				if entry := manifest.Demos[demo.Name]; opts.quarantineAfter > 0 && entry.Failures >= opts.quarantineAfter {
+					if err := quarantineDemo(demo, entry, err, opts.quarantineDir); err != nil {
+						slog.Warn(fmt.Sprintf("Couldn't quarantine %v: %v", demo.Name, err))
+					} else {
+						result.Status = StatusQuarantined
+					}
+				}
+			} else {
+				slog.Info(fmt.Sprintf("%v parsing succeeded", demo.Name))
+
+				if err := manifest.recordParsed(demo.Name, hash, parsedDir, parserVersion, opts.collectors()); err != nil {
+					slog.Warn(fmt.Sprintf("Couldn't add %v to the manifest: %v", demo.Name, err))
+				} else if opts.eventsDir != "" {
+					// Duplicates don't keep their event cache either
+					entry := manifest.Demos[demo.Name]
+					if entry.Status == StatusParsed {
+						entry.Outputs = append(entry.Outputs, eventCachePath(opts.eventsDir, demo.Name))
 					} else {
-						slog.Info(fmt.Sprintf("%v parsing succeeded", demo.Name()))
+						os.Remove(eventCachePath(opts.eventsDir, demo.Name))
 					}
 				}
+
+				if entry := manifest.Demos[demo.Name]; entry != nil {
+					result.Status = entry.Status
+				}
+			}
+			if entry := manifest.Demos[demo.Name]; entry != nil {
+				result.Outputs = entry.Outputs
+			}
+			if err := manifest.save(manifestFile); err != nil {
+				slog.Error(fmt.Sprintf("Error saving manifest: %v", err))
 			}
-			// break // ---------------------------------------------PARSE ONLY ONE DEMO FOR DEBUGGINGS----------------------------------------------------------------- //
+			results = append(results, result)
 		}
+		// break // ---------------------------------------------PARSE ONLY ONE DEMO FOR DEBUGGINGS----------------------------------------------------------------- //
+	}
+
+	return results
+}
+
+func checkParsedDemo(manifest *Manifest, demo demoInput, parsedDir string) error {
+	hash, err := demo.hash()
+	if err != nil {
+		return err
 	}
+	return manifest.recordParsed(demo.Name, hash, parsedDir, 0, nil)
 }
 
-func parseSingleDemo(demosDir string, filename string, parsedDir string) (err error) {
+// Options that apply to every parsed demo
+type parseOptions struct {
+	roster          *Roster
+	matchDate       time.Time           // Set per demo
+	reparseOutdated bool                // Parse again demos parsed with an older parser version
+	eventsDir       string              // Event cache is written here when set
+	progress        func(ProgressEvent) // Called with parse progress and after every round when set
+	timeout         time.Duration       // Parsing a demo is cancelled after this long, 0 for no limit
+	quarantineDir   string              // Demos that failed quarantineAfter times in a row are moved here
+	quarantineAfter int                 // 0 to never quarantine
+}
+
+func parseSingleDemo(ctx context.Context, demo demoInput, parsedDir string, opts parseOptions) (scoreboard Scoreboard, err error) {
+	filename := demo.Name
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
 	defer TimeTrackFile(time.Now(), filename)
 
 	slog.Info(fmt.Sprintf("%v started parsing", filename))
 
-	file, err := os.Open(demosDir + filename)
+	file, err := demo.open()
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error opening demo file: %v", filename))
-		return err
+		slog.Error(fmt.Sprintf("Error opening demo file: %v", demo))
+		return scoreboard, err
 	}
 	defer file.Close()
 
+	opts.matchDate = matchDate(filename, demo.ModTime)
+
+	scoreboard, cache, err := parseDemo(ctx, file, filename, opts)
+	if err != nil {
+		return scoreboard, err
+	}
+
+	err = scoreboard.saveJson(filename+"_scoreboard.json", parsedDir)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error saving scoreboard to CSV from demo: %v", filename))
+		return scoreboard, err
+	}
+
+	if cache != nil {
+		if err = cache.save(eventCachePath(opts.eventsDir, filename)); err != nil {
+			slog.Error(fmt.Sprintf("Error saving event cache of %v", filename))
+			return scoreboard, err
+		}
+	}
+
+	return
+}
+
+// Parses a demo from any reader. Filename is used for logging and the event cache. The event cache is nil
+// unless opts.eventsDir is set. Cancelling the context stops the parser between frames
+func parseDemo(ctx context.Context, r io.Reader, filename string, opts parseOptions) (scoreboard Scoreboard, cache *EventCache, err error) {
+	// Panics in the parser or the handlers fail only this demo
+	var p dem.Parser
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error(fmt.Sprintf("Parsing %v panicked: %v", filename, r))
+			pe := newParseError(fmt.Errorf("panic: %v", r), p, scoreboard.RoundsPlayed+1)
+			pe.Panic = true
+			pe.Stack = string(debug.Stack())
+			scoreboard, cache, err = Scoreboard{Warnings: scoreboard.Warnings}, nil, pe
+		}
+	}()
+
 	// Parse the demo file
-	p := dem.NewParser(file)
+	p = dem.NewParser(&holdEOFReader{r: r})
 	defer p.Close()
 
-	var scoreboard Scoreboard
 	var kniferound []KniferoundStats
 	var scoreboardMutex sync.Mutex // Mutex to synchronize access to scoreboard
 	var roundStats RoundStats
 	var matchStarted bool
 	var scoreboardInitialized bool
 
+	// Events are kept in memory and written to the cache after parsing, nil when caching is off
+	if opts.eventsDir != "" {
+		cache = &EventCache{EventCacheHeader: EventCacheHeader{Demo: filename}}
+	}
+
+	newEvent := func(kind EventKind) CachedEvent {
+		return CachedEvent{Kind: kind, Tick: int32(p.GameState().IngameTick()), Time: p.CurrentTime(), Round: int16(scoreboard.RoundsPlayed + 1)}
+	}
+
 	previousFlashId := 0 // For some reason flashexplode events appear twice, so with these we can keep track of counted flashes
 	var previousFlashThrower *common.Player
 
@@ -118,14 +413,18 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 			updateKnife = true
 		}
 
-		// Initialize the scoreboard at the beginning of the match
-		scoreboard = initializeScoreboard(p.GameState())
+		// Initialize the scoreboard at the beginning of the match. Warnings from before are kept
+		warnings := scoreboard.Warnings
+		scoreboard = initializeScoreboard(p.GameState(), opts)
+		scoreboard.Warnings = append(warnings, scoreboard.Warnings...)
+		scoreboard.MatchStartTick = p.GameState().IngameTick()
+		cache.reset()
 
 		// string to int
 		i, err := strconv.Atoi(p.GameState().Rules().ConVars()["mp_maxrounds"])
 		if err != nil {
-			slog.Error("mp_maxrounds is not a number!")
-			panic(err)
+			i = defaultMaxRounds
+			scoreboard.warn(WarnUnknownMaxRounds, 0, fmt.Sprintf("mp_maxrounds is not a number, using %v", i))
 		}
 
 		scoreboard.MaxRounds = i
@@ -144,7 +443,7 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		}
 
 		if !matchStarted && scoreboardInitialized {
-			slog.Warn("Scoreboard was initialized before match start. Stats might have something funky going on.")
+			scoreboard.warn(WarnInitializedEarly, scoreboard.RoundsPlayed+1, "Scoreboard was initialized before match start. Stats might have something funky going on.")
 		}
 
 		matchStarted = true
@@ -159,8 +458,9 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		defer scoreboardMutex.Unlock()
 
 		if !matchStarted && !scoreboardInitialized {
-			slog.Warn("Demofile doesn't have match start event in the beginning of file. Something will likely fail. Initializing scoreboard.")
-			scoreboard = initializeScoreboard(p.GameState())
+			scoreboard = initializeScoreboard(p.GameState(), opts)
+			scoreboard.warn(WarnMissingMatchStart, scoreboard.RoundsPlayed+1, "Demofile doesn't have match start event in the beginning of file. Something will likely fail. Initializing scoreboard.")
+			scoreboard.MatchStartTick = p.GameState().IngameTick()
 			scoreboardInitialized = true
 		}
 
@@ -168,10 +468,70 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		ts := p.GameState().TeamTerrorists()
 
 		roundStats = initializeRoundStats(scoreboard, cts, ts)
+		cache.add(newEvent(EventRoundStart))
 
 		slog.Debug(fmt.Sprintf("Round %v start", scoreboard.RoundsPlayed+1))
 	})
 
+	p.RegisterEventHandler(func(e events.RoundFreezetimeEnd) {
+		scoreboardMutex.Lock() // Lock the mutex before accessing scoreboard
+		defer scoreboardMutex.Unlock()
+
+		roundStats.FreezetimeEnded = true
+		roundStats.FreezetimeEndTime = p.CurrentTime()
+		roundStats.LastFrameTime = p.CurrentTime()
+	})
+
+	p.RegisterEventHandler(func(e events.PlayerSpottersChanged) {
+		scoreboardMutex.Lock() // Lock the mutex before accessing scoreboard
+		defer scoreboardMutex.Unlock()
+
+		// Ensure scoreboard is initialized
+		if scoreboard.PlayerScores == nil {
+			return
+		}
+
+		updateSpotted(e.Spotted, roundStats, p.CurrentTime())
+	})
+
+	// Progress is reported once per percent
+	lastPercent := 0
+	p.RegisterEventHandler(func(e events.FrameDone) {
+		if opts.progress == nil {
+			return
+		}
+
+		progress := p.Progress()
+		if percent := int(progress * 100); percent > lastPercent {
+			lastPercent = percent
+			opts.progress(ProgressEvent{Type: "progress", Demo: filename, Progress: float64(progress)})
+		}
+	})
+
+	p.RegisterEventHandler(func(e events.FrameDone) {
+		scoreboardMutex.Lock() // Lock the mutex before accessing scoreboard
+		defer scoreboardMutex.Unlock()
+
+		// Movement is tracked only while the round is live
+		if scoreboard.PlayerScores == nil || !roundStats.FreezetimeEnded || roundStats.RoundEnded {
+			return
+		}
+
+		now := p.CurrentTime()
+		dt := (now - roundStats.LastFrameTime).Seconds()
+		roundStats.LastFrameTime = now
+
+		for _, player := range p.GameState().Participants().Playing() {
+			if player.Entity == nil || !player.IsAlive() {
+				delete(roundStats.LastPositions, player.SteamID64)
+				continue
+			}
+
+			ps := scoreboard.getPlayerScore(player)
+			ps.updateMovement(player, &roundStats, dt, scoreboard.RoundsPlayed+1)
+		}
+	})
+
 	p.RegisterEventHandler(func(e events.RoundEnd) {
 		scoreboardMutex.Lock() // Lock the mutex before accessing scoreboard
 		defer scoreboardMutex.Unlock()
@@ -180,6 +540,10 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 
 		// if !mat
 
+		if clutch := roundStats.finishClutch(e.Winner); clutch != nil {
+			scoreboard.Clutches = append(scoreboard.Clutches, *clutch)
+		}
+
 		var ps *PlayerScore
 		for _, player := range p.GameState().Participants().Playing() {
 			scoreboard.PlayerScores, ps = scoreboard.getAddPlayerScore(player)
@@ -190,59 +554,56 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 			ps.MoneySpentTotal = player.MoneySpentTotal()
 			ps.TeamRounds = player.TeamState.Score()
 			ps.PlayedRounds += 1
+			ps.addAlias(player.Name)
 
 			slog.Debug(fmt.Sprintf("Player %v	Team id %v", player.Name, ps.playerRef.TeamState.ID()))
 
-			switch roundStats.KillsOnRound[ps.SteamID] {
-			case 2:
-				ps.Enemy2k += 1
-			case 3:
-				ps.Enemy3k += 1
-			case 4:
-				ps.Enemy4k += 1
-			case 5:
-				ps.Enemy5k += 1
-			}
-
-			if roundStats.ClutchingPlayer != nil && roundStats.ClutchingPlayer.Team == e.Winner && roundStats.ClutchingPlayer.SteamID64 == player.SteamID64 {
-				switch roundStats.EnemiesToClutch {
-				case 1:
-					ps.ClutchV1Wins += 1
-				case 2:
-					ps.ClutchV2Wins += 1
-				case 3:
-					ps.ClutchV3Wins += 1
-				case 4:
-					ps.ClutchV4Wins += 1
-				case 5:
-					ps.ClutchV5Wins += 1
-				}
-			}
-
-			if roundStats.Clutch1V1 != nil && roundStats.Clutch1V1.Team == e.Winner && roundStats.Clutch1V1.SteamID64 == player.SteamID64 {
-				ps.ClutchV1Wins += 1
+			roundStats.endRound(ps, player.IsAlive())
+
+			snapshot := newEvent(EventPlayer)
+			snapshot.Player = player.SteamID64
+			snapshot.Side = int8(player.Team)
+			snapshot.Snapshot = &PlayerSnapshot{
+				Name:       player.Name,
+				Clan:       ps.Team,
+				TeamId:     ps.TeamId,
+				Alive:      player.IsAlive(),
+				Kills:      ps.Kills,
+				Assists:    ps.Assists,
+				Deaths:     ps.Deaths,
+				Mvps:       ps.Mvps,
+				MoneySpent: ps.MoneySpentTotal,
+				TeamRounds: ps.TeamRounds,
 			}
+			cache.add(snapshot)
 
-			if player.IsAlive() {
-				roundStats.Kast[player.SteamID64] = true
-			} else {
-				timeOfDeath := roundStats.TimeOfDeath[player.SteamID64]
-				killerID := roundStats.Killers[player.SteamID64]
-
-				for id, v := range roundStats.TimeOfDeath {
-					if id == killerID && v-timeOfDeath < 2*10^9 {
-						roundStats.Kast[player.SteamID64] = true
-					}
-				}
-			}
+		}
 
-			ps.Kast += float64(boolToInt(roundStats.Kast[player.SteamID64]))
+		scoreboard.addRoundResult(e, p.GameState().TeamCounterTerrorists(), p.GameState().TeamTerrorists())
 
-		}
+		roundEnd := newEvent(EventRoundEnd)
+		roundEnd.Value = int32(e.Winner)
+		roundEnd.Reason = int8(e.Reason)
+		cache.add(roundEnd)
 
 		scoreboard.RoundsPlayed = p.GameState().TotalRoundsPlayed()
 
 		scoreboard.addResidualDamage(roundStats.RoundHealths)
+		for _, rh := range roundStats.RoundHealths {
+			if rh.PlayerWhoGetsTheDamage != 0 {
+				residual := newEvent(EventResidualDamage)
+				residual.Round -= 1 // Rounds played was already updated
+				residual.Player = rh.PlayerWhoGetsTheDamage
+				residual.Target = rh.SteamID
+				residual.Value = int32(rh.MinHealthAboveZero)
+				cache.add(residual)
+			}
+		}
+		scoreboard.addRoundSnapshot()
+
+		if opts.progress != nil {
+			opts.progress(scoreboard.roundProgress(filename, p.Progress()))
+		}
 
 		roundStats.RoundEnded = true
 
@@ -280,43 +641,18 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		}
 
 		if victimTeamAlive == 1 && !roundStats.RoundEnded {
-			if roundStats.ClutchingPlayer == nil {
-				for _, playa := range e.Victim.TeamState.Opponent.Members() {
-					if playa.IsAlive() {
-						roundStats.EnemiesToClutch += 1
-					}
-				}
+			var timeRemaining time.Duration
+			if roundTime, err := p.GameState().Rules().RoundTime(); err == nil && roundStats.FreezetimeEnded {
+				timeRemaining = roundTime - (p.CurrentTime() - roundStats.FreezetimeEndTime)
 			}
 
-			members := e.Victim.TeamState.Members()
-			for i, playa := range members {
-				if playa.IsAlive() && playa.SteamID64 != e.Victim.SteamID64 {
-					ps := scoreboard.getPlayerScore(members[i])
+			roundStats.startClutch(e.Victim, scoreboard.RoundsPlayed+1, timeRemaining)
+		}
 
-					if roundStats.ClutchingPlayer != nil {
-						roundStats.Clutch1V1 = members[i]
-						ps.ClutchV1Count += 1
-					} else {
-						roundStats.ClutchingPlayer = members[i]
-
-						switch roundStats.EnemiesToClutch {
-						case 1:
-							ps.ClutchV1Count += 1
-						case 2:
-							ps.ClutchV2Count += 1
-						case 3:
-							ps.ClutchV3Count += 1
-						case 4:
-							ps.ClutchV4Count += 1
-						case 5:
-							ps.ClutchV5Count += 1
-						}
-					}
+		roundStats.updateClutchKill(e.Killer, e.Victim)
 
-					break
-				}
-			}
-		}
+		scoreboard.addPosition("kill", e.Killer)
+		scoreboard.addPosition("death", e.Victim)
 
 		if e.Weapon != nil {
 			killer.KillsByWeapon[e.Weapon.String()] += 1
@@ -324,13 +660,9 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		}
 
 		timestamp := p.CurrentTime()
-		roundStats.TimeOfDeath[victim.SteamID] = timestamp
+		roundStats.addKill(killer.SteamID, victim.SteamID, assister.SteamID, timestamp)
 
-		if killer.SteamID != victim.SteamID {
-			roundStats.Killers[victim.SteamID] = killer.SteamID
-			roundStats.Kast[killer.SteamID] = true
-			roundStats.Kast[assister.SteamID] = true
-		}
+		scoreboard.KillMatrix.add(e.Killer, e.Victim, 1)
 
 		/*
 			0	teamkill
@@ -356,74 +688,30 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		killer.KillsByType[killtype] += 1
 		victim.DeathsByType[killtype] += 1
 
-		if e.Weapon.Type == 407 { // 407 World damage
-			victim.Suicides += 1
-		} else {
-			if getPlayerTeam(e.Killer) != getPlayerTeam(e.Victim) {
-				roundStats.KillsOnRound[killer.SteamID] += 1
+		scoreboard.addKillEvent(e, killtype, timestamp)
 
-				if e.PenetratedObjects > 0 {
-					killer.WallBangKills += 1
-					victim.WallBangDeaths += 1
-				}
-				if e.IsHeadshot {
-					killer.HeadshotKills += 1
-					victim.HeadshotDeaths += 1
-				}
-				if e.AttackerBlind {
-					killer.BlindKills += 1
-					victim.BlindDeaths += 1
-				}
-				if e.NoScope {
-					killer.NoscopeKills += 1
-					victim.NoscopeDeaths += 1
-				}
-				if e.ThroughSmoke {
-					killer.SmokeKills += 1
-					victim.SmokeDeaths += 1
-				}
-				if !roundStats.EnemiesKilled {
-					roundStats.EnemiesKilled = true
-					killer.EntryCount += 1
-					killer.EntryWins += 1
-					victim.EntryCount += 1
-				}
-
-				if e.AssistedFlash {
-					killer.FlashKills += 1
-					victim.FlashDeaths += 1
-
-					assister.FlashAssists += 1
-				}
-			} else {
-				if e.PenetratedObjects > 0 {
-					killer.TeamWallBangKills += 1
-					victim.TeamWallBangDeaths += 1
-				}
-				if e.IsHeadshot {
-					killer.TeamHeadshotKills += 1
-					victim.TeamHeadshotDeaths += 1
-				}
-				if e.AttackerBlind {
-					killer.TeamBlindKills += 1
-					victim.TeamBlindDeaths += 1
-				}
-				if e.NoScope {
-					killer.TeamNoscopeKills += 1
-					victim.TeamNoscopeDeaths += 1
-				}
-				if e.ThroughSmoke {
-					killer.TeamSmokeKills += 1
-					victim.TeamSmokeDeaths += 1
-				}
-
-				if e.AssistedFlash {
-					killer.TeamFlashKills += 1
-					victim.TeamFlashDeaths += 1
+		kill := newEvent(EventKill)
+		kill.Player, kill.Target, kill.Assister = getSteamID64(e.Killer), getSteamID64(e.Victim), getSteamID64(e.Assister)
+		kill.Side, kill.TargetSide = int8(getPlayerTeam(e.Killer)), int8(getPlayerTeam(e.Victim))
+		kill.Enemy = getPlayerTeam(e.Killer) != getPlayerTeam(e.Victim)
+		kill.Pos, kill.TargetPos = playerPos(e.Killer), playerPos(e.Victim)
+		kill.Value = int32(killtype)
+		if e.Weapon != nil {
+			kill.Weapon = e.Weapon.String()
+			kill.WeaponType = int16(e.Weapon.Type)
+		}
+		cache.add(kill)
 
-					assister.TeamFlashAssists += 1
-				}
+		if e.Weapon != nil && e.Weapon.Type == 407 { // 407 World damage
+			victim.Suicides += 1
+		} else {
+			enemyKill := getPlayerTeam(e.Killer) != getPlayerTeam(e.Victim)
+			if enemyKill {
+				roundStats.addEnemyKill(killer, victim)
+				killer.updateKillTiming(e.Killer, e.Victim, e.Weapon, roundStats, timestamp)
 			}
+
+			addKillCounters(killer, victim, assister, killtype, enemyKill)
 		}
 	})
 
@@ -455,21 +743,38 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 
 		thrower := scoreboard.getPlayerScore(e.Base().Thrower)
 
+		grenade := newEvent(EventGrenade)
+		grenade.Player = getSteamID64(e.Base().Thrower)
+		grenade.Side = int8(getPlayerTeam(e.Base().Thrower))
+		grenade.Pos = cachePos(e.Base().Position)
+
 		slog.Debug(fmt.Sprintf("%v throwed %v", e.Base().Thrower, e.Base().Grenade))
 
 		switch e.(type) {
 		case events.FlashExplode:
 			if previousFlashThrower != e.Base().Thrower || previousFlashId != e.Base().GrenadeEntityID {
 				thrower.FlashesThrown += 1
+				scoreboard.addGrenadePosition("flash", e.Base().Thrower, e.Base().Position)
+				grenade.Weapon = "flash"
+				cache.add(grenade)
 			}
 			previousFlashId = e.Base().GrenadeEntityID
 			previousFlashThrower = e.Base().Thrower
 		case events.HeExplode:
 			thrower.HesThrown += 1
+			scoreboard.addGrenadePosition("he", e.Base().Thrower, e.Base().Position)
+			grenade.Weapon = "he"
+			cache.add(grenade)
 		case events.SmokeStart:
 			thrower.SmokesThrown += 1
+			scoreboard.addGrenadePosition("smoke", e.Base().Thrower, e.Base().Position)
+			grenade.Weapon = "smoke"
+			cache.add(grenade)
 		case events.DecoyStart:
 			thrower.DecoysThrown += 1
+			scoreboard.addGrenadePosition("decoy", e.Base().Thrower, e.Base().Position)
+			grenade.Weapon = "decoy"
+			cache.add(grenade)
 		}
 
 	})
@@ -488,6 +793,15 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 		thrower := scoreboard.getPlayerScore(e.Inferno.Thrower())
 		thrower.BurnsThrown += 1
 
+		scoreboard.addGrenadePosition("molotov", e.Inferno.Thrower(), e.Inferno.Entity.Position())
+
+		grenade := newEvent(EventGrenade)
+		grenade.Player = getSteamID64(e.Inferno.Thrower())
+		grenade.Side = int8(getPlayerTeam(e.Inferno.Thrower()))
+		grenade.Pos = cachePos(e.Inferno.Entity.Position())
+		grenade.Weapon = "molotov"
+		cache.add(grenade)
+
 	})
 
 	p.RegisterEventHandler(func(e events.WeaponFire) {
@@ -501,6 +815,8 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 
 		shooter := scoreboard.getPlayerScore(e.Shooter)
 		shooter.ShotsFired += 1
+		shooter.updateShotMovement(e.Shooter, roundStats)
+		shooter.updateReactionTime(e.Shooter, e.Weapon, roundStats, p.CurrentTime())
 
 	})
 
@@ -527,37 +843,21 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 			return
 		}
 
-		slog.Debug(fmt.Sprintf("%v flashed %v for %.2f seconds", e.Attacker, e.Player, e.Player.FlashDuration))
-
 		attacker := scoreboard.getPlayerScore(e.Attacker)
 		receiver := scoreboard.getPlayerScore(e.Player)
 
+		flash := newEvent(EventFlash)
+		flash.Player, flash.Target = getSteamID64(e.Attacker), getSteamID64(e.Player)
+		flash.Enemy = getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker)
 		if e.Player != nil {
-			if getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker) {
-				if e.Player.FlashDuration > 1.1 {
-					attacker.EnemiesFullFlashed += 1
-					receiver.FullFlashesReceived += 1
-				} else {
-					attacker.EnemiesHalfFlashed += 1
-					receiver.HalfFlashesReceived += 1
-				}
-			} else {
-				if attacker != receiver {
-					if e.Player.FlashDuration > 1.1 {
-						receiver.TeamFullFlashesReceived += 1
-						attacker.TeammatesFullFlashed += 1
-					} else {
-						receiver.TeamHalfFlashesReceived += 1
-						attacker.TeammatesHalfFlashed += 1
-					}
-				} else {
-					if e.Player.FlashDuration > 1.1 {
-						attacker.SelfFullFlashes += 1
-					} else {
-						attacker.SelfHalfFlashes += 1
-					}
-				}
-			}
+			flash.Duration = e.Player.FlashDuration
+		}
+		cache.add(flash)
+
+		if e.Player != nil {
+			slog.Debug(fmt.Sprintf("%v flashed %v for %.2f seconds", e.Attacker, e.Player, e.Player.FlashDuration))
+			scoreboard.FlashMatrix.add(e.Attacker, e.Player, float64(e.Player.FlashDuration))
+			addFlashCounters(attacker, receiver, e.Player.FlashDuration, getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker))
 		} else {
 			if getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker) {
 				attacker.EnemiesFullFlashed += 1
@@ -594,7 +894,13 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 
 		slog.Debug(fmt.Sprintf("%v caused %v damage to %v with %v", e.Attacker, e.HealthDamageTaken, e.Player, e.Weapon))
 
-		if scoreboard.knifeRoundMatch && e.Weapon.Type != common.EqKnife && e.HealthDamageTaken > 0 {
+		// Weapon is nil e.g. for fall damage
+		weaponType := common.EqUnknown
+		if e.Weapon != nil {
+			weaponType = e.Weapon.Type
+		}
+
+		if scoreboard.knifeRoundMatch && weaponType != common.EqKnife && e.HealthDamageTaken > 0 {
 			scoreboard.knifeRoundMatch = false
 			slog.Debug("scoreboard.KnifeRoundMatch set to false")
 		}
@@ -610,77 +916,40 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 				dmg = e.HealthDamageTaken
 			}
 
-			if getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker) {
-				switch e.Weapon.Type {
-				case 502: // Molotov
-					attacker.BurnDamageDealt += dmg
-				case 503: // Incendiary
-					attacker.BurnDamageDealt += dmg
-				case 506: // He
-					attacker.HeDamageDealt += dmg
-				}
-
-				attacker.DamageDone += dmg
-				attacker.ShotsOnEnemies += 1
-
-				switch e.Weapon.Type {
-				case 502: // Molotov
-					receiver.BurnDamageReceived += dmg
-				case 503: // Incendiary
-					receiver.BurnDamageReceived += dmg
-				case 506: // He
-					receiver.HeDamageReceived += dmg
-				}
-
-				receiver.DamageReceived += dmg
-
-			} else {
-				switch e.Weapon.Type {
-				case 502: // Molotov
-					attacker.TeamBurnDamageDealt += dmg
-				case 503: // Incendiary
-					attacker.TeamBurnDamageDealt += dmg
-				case 506: // He
-					attacker.TeamHeDamageDealt += dmg
-				}
+			scoreboard.DamageMatrix.add(e.Attacker, e.Player, dmg)
 
-				attacker.TeamDamageDone += dmg
-				attacker.ShotsOnTeammates += 1
-
-				switch e.Weapon.Type {
-				case 502: // Molotov
-					receiver.TeamBurnDamageReceived += dmg
-				case 503: // Incendiary
-					receiver.TeamBurnDamageReceived += dmg
-				case 506: // He
-					receiver.TeamHeDamageReceived += dmg
-				}
-
-				if receiver == attacker {
-					switch e.Weapon.Type {
-					case 502: // Molotov
-						receiver.BurnSelfDamage += dmg
-					case 503: // Incendiary
-						receiver.BurnSelfDamage += dmg
-					case 506: // He
-						receiver.HeSelfDamage += dmg
-					}
-				}
-
-				receiver.TeamDamageReceived += dmg
+			enemy := getPlayerTeam(e.Player) != getPlayerTeam(e.Attacker)
+			addDamageCounters(attacker, receiver, dmg, weaponType, enemy)
 
+			hurt := newEvent(EventHurt)
+			hurt.Player, hurt.Target = getSteamID64(e.Attacker), getSteamID64(e.Player)
+			hurt.Enemy = enemy
+			hurt.Value = int32(dmg)
+			if e.Weapon != nil {
+				hurt.Weapon = e.Weapon.String()
+				hurt.WeaponType = int16(e.Weapon.Type)
+			}
+			cache.add(hurt)
+			if enemy {
+				attacker.updateDamageTiming(e.Attacker, e.Player, e.Weapon, roundStats, p.CurrentTime())
 			}
 		}
 	})
 
+	stopCancel := context.AfterFunc(ctx, p.Cancel)
+	defer stopCancel()
+
 	// Parse the demo
 	err = p.ParseToEnd()
 	if err != nil {
-		if errors.Is(err, dem.ErrUnexpectedEndOfDemo) {
-			slog.Warn(fmt.Sprintf("%v file incomplete. File has only %v complete rounds. Writing json still.", filename, scoreboard.RoundsPlayed))
+		if errors.Is(err, dem.ErrCancelled) {
+			slog.Error(fmt.Sprintf("%v parsing stopped after %v rounds: %v", filename, scoreboard.RoundsPlayed, ctx.Err()))
+			return scoreboard, nil, newParseError(fmt.Errorf("parsing stopped after %v rounds: %w", scoreboard.RoundsPlayed, ctx.Err()), p, scoreboard.RoundsPlayed+1)
+		} else if errors.Is(err, dem.ErrUnexpectedEndOfDemo) {
+			scoreboard.warn(WarnIncompleteDemo, scoreboard.RoundsPlayed+1, fmt.Sprintf("%v file incomplete. File has only %v complete rounds. Writing json still.", filename, scoreboard.RoundsPlayed))
 		} else {
 			slog.Error(fmt.Sprintf("Error parsing demo: %v", filename))
-			return err
+			return scoreboard, nil, newParseError(err, p, scoreboard.RoundsPlayed+1)
 		}
 	}
 
@@ -688,11 +957,12 @@ func parseSingleDemo(demosDir string, filename string, parsedDir string) (err er
 
 	scoreboard.updatePostMatchStats()
 
-	err = scoreboard.saveJson(filename+"_scoreboard.json", parsedDir)
-	if err != nil {
-		slog.Error(fmt.Sprintf("Error saving scoreboard to CSV from demo: %v", filename))
-		return err
+	if cache != nil {
+		cache.Map = scoreboard.MapName
+		cache.MatchDate = scoreboard.MatchDate
+		cache.MatchStartTick = scoreboard.MatchStartTick
+		cache.MaxRounds = scoreboard.MaxRounds
 	}
 
-	return
+	return scoreboard, cache, nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/msgs2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Appends a demo command the way .dem files and broadcast fragments have them: command, tick, size and the message
+func appendDemoCommand(t *testing.T, b []byte, cmd msgs2.EDemoCommands, tick int, msg proto.Message) []byte {
+	t.Helper()
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = binary.AppendUvarint(b, uint64(cmd))
+	b = binary.AppendUvarint(b, uint64(tick))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func demoFileHeader(mapName string) *msgs2.CDemoFileHeader {
+	return &msgs2.CDemoFileHeader{DemoFileStamp: proto.String("PBDEMS2"), NetworkProtocol: proto.Int32(1), MapName: proto.String(mapName)}
+}
+
+// Smallest demo the parser gets through: the file header, a sync tick and the stop command. testdata/minimal.dem.bz2
+// is this compressed with the bzip2 command, the standard library can't write bzip2
+func minimalDemo(t *testing.T) []byte {
+	b := make([]byte, 16)
+	copy(b, "PBDEMS2\x00")
+	b = appendDemoCommand(t, b, msgs2.EDemoCommands_DEM_FileHeader, 0, demoFileHeader("de_test"))
+	b = appendDemoCommand(t, b, msgs2.EDemoCommands_DEM_SyncTick, 0, &msgs2.CDemoSyncTick{})
+	return appendDemoCommand(t, b, msgs2.EDemoCommands_DEM_Stop, 1, &msgs2.CDemoStop{})
+}
+
+func TestDecompressStream(t *testing.T) {
+	demo := minimalDemo(t)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(demo)
+	gw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll(demo, nil)
+
+	bz2, err := os.ReadFile("testdata/minimal.dem.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain", demo},
+		{"gzip", gz.Bytes()},
+		{"bzip2", bz2},
+		{"zstd", zst},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := decompressStream(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, demo) {
+				t.Errorf("decompressed %v bytes, want the %v bytes of the demo", len(got), len(demo))
+			}
+
+			// And the parser reads straight from the decompressor
+			r, err = decompressStream(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			sb, _, err := parseDemo(context.Background(), r, "test.dem", parseOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sb.MapName != "de_test" {
+				t.Errorf("map is %q, want de_test", sb.MapName)
+			}
+			if len(sb.Warnings) != 0 {
+				t.Errorf("unexpected warnings %+v", sb.Warnings)
+			}
+		})
+	}
+}
+
+func TestParseDemo(t *testing.T) {
+	demo := minimalDemo(t)
+
+	sb, _, err := parseDemo(context.Background(), bytes.NewReader(demo), "test.dem", parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.MapName != "de_test" || sb.RoundsPlayed != 0 {
+		t.Errorf("got map %q with %v rounds, want de_test with 0", sb.MapName, sb.RoundsPlayed)
+	}
+}
+
+func TestParseDemoIncomplete(t *testing.T) {
+	demo := minimalDemo(t)
+
+	// Cut in the middle of the stop command, like a demo whose recording was cut off
+	sb, _, err := parseDemo(context.Background(), bytes.NewReader(demo[:len(demo)-2]), "test.dem", parseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sb.Warnings) != 1 || sb.Warnings[0].Code != WarnIncompleteDemo {
+		t.Errorf("warnings are %+v, want one %v", sb.Warnings, WarnIncompleteDemo)
+	}
+}
+
+func TestParseDemoNotADemo(t *testing.T) {
+	_, _, err := parseDemo(context.Background(), bytes.NewReader([]byte("not a demo at all")), "test.dem", parseOptions{})
+	if err == nil {
+		t.Fatal("parsed something that isn't a demo")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"time"
+
+	"github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+// Counter updates shared by the demo parser and the event cache recompute, so both count the same way
+
+// Killer's death within this long after the victim's counts as a trade for KAST
+func traded(timeOfDeath time.Duration, killerDeath time.Duration) bool {
+	d := killerDeath - timeOfDeath
+	return d >= 0 && d <= 2*time.Second
+}
+
+// Per round state for KAST and entry kills. Part of RoundStats in the parser and replayRound in the recompute
+type kastRound struct {
+	KillsOnRound  map[uint64]int
+	EnemiesKilled bool
+	Killers       map[uint64]uint64 // Killers need to be tracked to check for trades
+	Kast          map[uint64]bool
+	TimeOfDeath   map[uint64]time.Duration
+}
+
+func newKastRound() kastRound {
+	return kastRound{
+		KillsOnRound: make(map[uint64]int),
+		Killers:      make(map[uint64]uint64),
+		Kast:         make(map[uint64]bool),
+		TimeOfDeath:  make(map[uint64]time.Duration),
+	}
+}
+
+// Every kill, suicides too. Killer and assister get KAST and the death is kept for trades
+func (kr *kastRound) addKill(killerID uint64, victimID uint64, assisterID uint64, timestamp time.Duration) {
+	kr.TimeOfDeath[victimID] = timestamp
+
+	if killerID != victimID {
+		kr.Killers[victimID] = killerID
+		kr.Kast[killerID] = true
+		kr.Kast[assisterID] = true
+	}
+}
+
+// First enemy kill of the round is the entry
+func (kr *kastRound) addEnemyKill(killer *PlayerScore, victim *PlayerScore) {
+	kr.KillsOnRound[killer.SteamID] += 1
+
+	if !kr.EnemiesKilled {
+		kr.EnemiesKilled = true
+		killer.EntryCount += 1
+		killer.EntryWins += 1
+		victim.EntryCount += 1
+	}
+}
+
+// Survivors and traded players get KAST, then the round's multikill and KAST counters are added
+func (kr *kastRound) endRound(ps *PlayerScore, alive bool) {
+	if alive {
+		kr.Kast[ps.SteamID] = true
+	} else {
+		timeOfDeath := kr.TimeOfDeath[ps.SteamID]
+		killerID := kr.Killers[ps.SteamID]
+
+		for id, v := range kr.TimeOfDeath {
+			if id == killerID && traded(timeOfDeath, v) {
+				kr.Kast[ps.SteamID] = true
+			}
+		}
+	}
+
+	ps.addRoundCounters(kr.KillsOnRound[ps.SteamID], kr.Kast[ps.SteamID])
+}
+
+// Kill type counters from the kill type bits. World damage suicides are counted by the caller
+func addKillCounters(killer *PlayerScore, victim *PlayerScore, assister *PlayerScore, killtype uint32, enemyKill bool) {
+	wallbang := killtype&4 != 0
+	headshot := killtype&8 != 0
+	noscope := killtype&16 != 0
+	blind := killtype&32 != 0
+	flashAssist := killtype&64 != 0
+	smoke := killtype&2 != 0
+
+	if enemyKill {
+		if wallbang {
+			killer.WallBangKills += 1
+			victim.WallBangDeaths += 1
+		}
+		if headshot {
+			killer.HeadshotKills += 1
+			victim.HeadshotDeaths += 1
+		}
+		if blind {
+			killer.BlindKills += 1
+			victim.BlindDeaths += 1
+		}
+		if noscope {
+			killer.NoscopeKills += 1
+			victim.NoscopeDeaths += 1
+		}
+		if smoke {
+			killer.SmokeKills += 1
+			victim.SmokeDeaths += 1
+		}
+
+		if flashAssist {
+			killer.FlashKills += 1
+			victim.FlashDeaths += 1
+
+			assister.FlashAssists += 1
+		}
+	} else {
+		if wallbang {
+			killer.TeamWallBangKills += 1
+			victim.TeamWallBangDeaths += 1
+		}
+		if headshot {
+			killer.TeamHeadshotKills += 1
+			victim.TeamHeadshotDeaths += 1
+		}
+		if blind {
+			killer.TeamBlindKills += 1
+			victim.TeamBlindDeaths += 1
+		}
+		if noscope {
+			killer.TeamNoscopeKills += 1
+			victim.TeamNoscopeDeaths += 1
+		}
+		if smoke {
+			killer.TeamSmokeKills += 1
+			victim.TeamSmokeDeaths += 1
+		}
+
+		if flashAssist {
+			killer.TeamFlashKills += 1
+			victim.TeamFlashDeaths += 1
+
+			assister.TeamFlashAssists += 1
+		}
+	}
+}
+
+func addDamageCounters(attacker *PlayerScore, receiver *PlayerScore, dmg int, weaponType common.EquipmentType, enemy bool) {
+	if enemy {
+		switch weaponType {
+		case 502: // Molotov
+			attacker.BurnDamageDealt += dmg
+		case 503: // Incendiary
+			attacker.BurnDamageDealt += dmg
+		case 506: // He
+			attacker.HeDamageDealt += dmg
+		}
+
+		attacker.DamageDone += dmg
+		attacker.ShotsOnEnemies += 1
+
+		switch weaponType {
+		case 502: // Molotov
+			receiver.BurnDamageReceived += dmg
+		case 503: // Incendiary
+			receiver.BurnDamageReceived += dmg
+		case 506: // He
+			receiver.HeDamageReceived += dmg
+		}
+
+		receiver.DamageReceived += dmg
+		return
+	}
+
+	switch weaponType {
+	case 502: // Molotov
+		attacker.TeamBurnDamageDealt += dmg
+	case 503: // Incendiary
+		attacker.TeamBurnDamageDealt += dmg
+	case 506: // He
+		attacker.TeamHeDamageDealt += dmg
+	}
+
+	attacker.TeamDamageDone += dmg
+	attacker.ShotsOnTeammates += 1
+
+	switch weaponType {
+	case 502: // Molotov
+		receiver.TeamBurnDamageReceived += dmg
+	case 503: // Incendiary
+		receiver.TeamBurnDamageReceived += dmg
+	case 506: // He
+		receiver.TeamHeDamageReceived += dmg
+	}
+
+	if receiver == attacker {
+		switch weaponType {
+		case 502: // Molotov
+			receiver.BurnSelfDamage += dmg
+		case 503: // Incendiary
+			receiver.BurnSelfDamage += dmg
+		case 506: // He
+			receiver.HeSelfDamage += dmg
+		}
+	}
+
+	receiver.TeamDamageReceived += dmg
+}
+
+func addFlashCounters(attacker *PlayerScore, receiver *PlayerScore, duration float32, enemy bool) {
+	full := duration > 1.1
+
+	if enemy {
+		if full {
+			attacker.EnemiesFullFlashed += 1
+			receiver.FullFlashesReceived += 1
+		} else {
+			attacker.EnemiesHalfFlashed += 1
+			receiver.HalfFlashesReceived += 1
+		}
+		return
+	}
+
+	if attacker != receiver {
+		if full {
+			receiver.TeamFullFlashesReceived += 1
+			attacker.TeammatesFullFlashed += 1
+		} else {
+			receiver.TeamHalfFlashesReceived += 1
+			attacker.TeammatesHalfFlashed += 1
+		}
+	} else {
+		if full {
+			attacker.SelfFullFlashes += 1
+		} else {
+			attacker.SelfHalfFlashes += 1
+		}
+	}
+}
+
+// Multikills and KAST at the end of a round
+func (ps *PlayerScore) addRoundCounters(kills int, kast bool) {
+	switch kills {
+	case 2:
+		ps.Enemy2k += 1
+	case 3:
+		ps.Enemy3k += 1
+	case 4:
+		ps.Enemy4k += 1
+	case 5:
+		ps.Enemy5k += 1
+	}
+
+	ps.Kast += float64(boolToInt(kast))
+}
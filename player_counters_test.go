@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTradedKast(t *testing.T) {
+	tests := []struct {
+		name        string
+		killerDeath time.Duration
+		kast        float64
+	}{
+		{"traded after 1s", 11 * time.Second, 1},
+		{"killer died after 3s", 13 * time.Second, 0},
+		{"killer died earlier", 9 * time.Second, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr := newKastRound()
+			kr.addKill(2, 1, 0, 10*time.Second)
+			kr.addKill(3, 2, 0, tt.killerDeath)
+
+			victim := PlayerScore{SteamID: 1}
+			kr.endRound(&victim, false)
+			if victim.Kast != tt.kast {
+				t.Errorf("KAST is %v, want %v", victim.Kast, tt.kast)
+			}
+		})
+	}
+}
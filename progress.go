@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Live update while a demo parses, given to parseOptions.progress
+type ProgressEvent struct {
+	Type       string           `json:"type"` // progress, round or scoreboard
+	Demo       string           `json:"demo"`
+	Progress   float64          `json:"progress"` // Share of the demo parsed, stays 0 when the demo header has no frame count
+	Round      int              `json:"round,omitempty"`
+	Winner     int              `json:"winner,omitempty"` // 2 T, 3 CT
+	Reason     int              `json:"reason,omitempty"`
+	Score      map[int]int      `json:"score,omitempty"` // Rounds won by team id, clan names are empty in pugs
+	Players    []ProgressPlayer `json:"players,omitempty"`
+	Scoreboard *Scoreboard      `json:"scoreboard,omitempty"` // Only on the last line of parse -progress
+}
+
+// Running stats of a player after a round. Copied out of the scoreboard so it can be written while parsing goes on
+type ProgressPlayer struct {
+	SteamID    uint64  `json:"steam_id"`
+	Nickname   string  `json:"nickname"`
+	Team       string  `json:"team"`
+	TeamId     int     `json:"team_id"`
+	Kills      int     `json:"kills"`
+	Assists    int     `json:"assists"`
+	Deaths     int     `json:"deaths"`
+	DamageDone int     `json:"damage_done"`
+	ADR        float64 `json:"adr"`
+	Kast       float64 `json:"kast"`
+	Rating     float64 `json:"rating"`
+}
+
+func (sb *Scoreboard) roundProgress(demo string, progress float32) ProgressEvent {
+	ev := ProgressEvent{
+		Type:     "round",
+		Demo:     demo,
+		Progress: float64(progress),
+		Round:    sb.RoundsPlayed,
+		Score:    make(map[int]int),
+	}
+
+	if len(sb.Rounds) > 0 {
+		last := sb.Rounds[len(sb.Rounds)-1]
+		ev.Winner = last.Winner
+		ev.Reason = last.Reason
+	}
+
+	for _, ps := range sb.PlayerScores {
+		// Copy, the calculations overwrite the running totals
+		p := ps
+		if p.PlayedRounds > 0 {
+			p.calculateADR(p.PlayedRounds)
+			p.calculateKAST(p.PlayedRounds)
+			p.calculateRating(p.PlayedRounds)
+		}
+
+		ev.Players = append(ev.Players, ProgressPlayer{
+			SteamID:    p.SteamID,
+			Nickname:   p.Nickname,
+			Team:       p.Team,
+			TeamId:     p.TeamId,
+			Kills:      p.Kills,
+			Assists:    p.Assists,
+			Deaths:     p.Deaths,
+			DamageDone: p.DamageDone,
+			ADR:        p.ADR,
+			Kast:       p.Kast,
+			Rating:     p.Rating,
+		})
+		ev.Score[p.TeamId] = p.TeamRounds
+	}
+
+	return ev
+}
+
+// Writes each event as a json line, e.g. to stdout for parse -progress
+func ndjsonProgress(w io.Writer) func(ProgressEvent) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	return func(ev ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(ev)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dem "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs"
+)
+
+// Where and why parsing a demo failed. Panics in the parser or in the event handlers become these too,
+// so one broken demo doesn't stop the whole batch
+type ParseError struct {
+	Message string `json:"message"`
+	Panic   bool   `json:"panic"`
+	Tick    int    `json:"tick"`
+	Round   int    `json:"round"` // Round being played when parsing failed
+	Stack   string `json:"stack,omitempty"`
+	err     error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v (tick %v, round %v)", e.Message, e.Tick, e.Round)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.err
+}
+
+// Parser is nil when it panicked while being created
+func newParseError(err error, p dem.Parser, round int) *ParseError {
+	pe := &ParseError{Message: err.Error(), Round: round, err: err}
+
+	// The parser turns panics in handlers into errors with the stack trace appended
+	if msg, stack, ok := strings.Cut(pe.Message, "\nstacktrace:\n"); ok {
+		pe.Message, pe.Stack, pe.Panic = msg, stack, true
+	}
+
+	if p != nil {
+		pe.Tick = p.GameState().IngameTick()
+	}
+
+	return pe
+}
+
+// Written next to a quarantined demo
+type QuarantineReport struct {
+	Demo          string      `json:"demo"`
+	Source        string      `json:"source"` // Where the demo was before it was moved
+	Hash          string      `json:"hash"`
+	Failures      int         `json:"failures"`
+	QuarantinedAt time.Time   `json:"quarantined_at"`
+	Error         *ParseError `json:"error"`
+}
+
+// Moves a demo that keeps failing out of the demos directory and writes an error report for it. Demos in zip
+// archives stay where they are since the archive has other demos too, they are only marked quarantined
+func quarantineDemo(demo demoInput, entry *ManifestEntry, err error, quarantineDir string) error {
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		pe = &ParseError{Message: err.Error()}
+	}
+
+	report := QuarantineReport{
+		Demo:          demo.Name,
+		Source:        demo.String(),
+		Hash:          entry.Hash,
+		Failures:      entry.Failures,
+		QuarantinedAt: time.Now(),
+		Error:         pe,
+	}
+
+	reportPath := filepath.Join(quarantineDir, demo.Name+".error.json")
+	err = writeFileAtomic(reportPath, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	})
+	if err != nil {
+		return err
+	}
+
+	entry.Outputs = []string{reportPath}
+
+	if demo.Entry == "" {
+		moved := filepath.Join(quarantineDir, filepath.Base(demo.Path))
+		if err := os.Rename(demo.Path, moved); err != nil {
+			return err
+		}
+		entry.Outputs = append(entry.Outputs, moved)
+	}
+
+	entry.Status = StatusQuarantined
+
+	slog.Warn(fmt.Sprintf("%v failed %v times, moved to %v", demo.Name, entry.Failures, quarantineDir))
+
+	return nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const queryIndexVersion = 2
+
+// The index keeps the kills of every parsed scoreboard, so queries don't need to open all the json files.
+// Files are reindexed when their size or modification time changes
+type QueryIndex struct {
+	Version int                     `json:"version"`
+	Files   map[string]*IndexedFile `json:"files"`
+}
+
+type IndexedFile struct {
+	ModTime    time.Time     `json:"mod_time"`
+	Size       int64         `json:"size"`
+	Map        string        `json:"map"`
+	Date       time.Time     `json:"date"`
+	MergedFrom []string      `json:"merged_from,omitempty"`
+	Kills      []IndexedKill `json:"kills"`
+}
+
+type IndexedKill struct {
+	KillEvent
+	KillerName string `json:"killer_name"`
+	KillerTeam string `json:"killer_team"`
+	VictimName string `json:"victim_name"`
+	VictimTeam string `json:"victim_team"`
+}
+
+// Same order as the bits in KillsByType
+var killTypeNames = []string{"teamkill", "smoke", "wallbang", "headshot", "noscope", "blind", "flash", "suicide"}
+
+var queryColumns = []string{"date", "match", "map", "round", "time", "killer", "killer_id", "killer_team", "victim", "victim_id", "victim_team", "assister_id", "weapon", "type", "kill_type", "side"}
+
+type killQuery struct {
+	player      uint64
+	team        string
+	role        string
+	mapName     string
+	from        time.Time
+	to          time.Time
+	weapon      string
+	withBits    uint32
+	withoutBits uint32
+}
+
+func queryCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	indexPath := fs.String("index", "data/query_index.json", "index file")
+	player := fs.Uint64("player", 0, "player SteamID64")
+	team := fs.String("team", "", "team (clan name)")
+	role := fs.String("role", "killer", "which side of the kill -player and -team match: killer, victim or any")
+	mapName := fs.String("map", "", "map name")
+	from := fs.String("from", "", "first date, YYYY-MM-DD or YYYY-MM")
+	to := fs.String("to", "", "last date, YYYY-MM-DD or YYYY-MM")
+	weapon := fs.String("weapon", "", "weapon name, e.g. AWP")
+	types := fs.String("type", "", "comma separated kill types, prefix with ! to exclude: "+strings.Join(killTypeNames, ", "))
+	columns := fs.String("columns", "date,map,round,killer,victim,weapon,type", "comma separated output columns: "+strings.Join(queryColumns, ", "))
+	format := fs.String("format", "table", "table or csv")
+	fs.Parse(args)
+
+	q := killQuery{player: *player, team: *team, role: *role, mapName: *mapName, weapon: *weapon}
+
+	if q.role != "killer" && q.role != "victim" && q.role != "any" {
+		return fmt.Errorf("unknown role %q", q.role)
+	}
+
+	var err error
+	if q.from, err = parseQueryDate(*from, false); err != nil {
+		return err
+	}
+	if q.to, err = parseQueryDate(*to, true); err != nil {
+		return err
+	}
+
+	if q.withBits, q.withoutBits, err = parseKillTypes(*types); err != nil {
+		return err
+	}
+
+	cols := strings.Split(*columns, ",")
+	for _, c := range cols {
+		if !slices.Contains(queryColumns, c) {
+			return fmt.Errorf("unknown column %q", c)
+		}
+	}
+
+	index, err := updateQueryIndex(*indexPath, parsedDir)
+	if err != nil {
+		return err
+	}
+
+	names := index.matchFiles()
+
+	var rows [][]string
+	for _, name := range names {
+		file := index.Files[name]
+		if !q.matchesFile(file) {
+			continue
+		}
+
+		for _, k := range file.Kills {
+			if q.matchesKill(k) {
+				rows = append(rows, queryRow(cols, name, file, k))
+			}
+		}
+	}
+
+	switch *format {
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(cols)
+		w.WriteAll(rows)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(cols, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		w.Flush()
+	}
+
+	slog.Info(fmt.Sprintf("%v kills matched", len(rows)))
+
+	return nil
+}
+
+// With end set, the date is moved to the end of the given day or month
+func parseQueryDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+
+	if t, err := time.Parse("2006-01", value); err == nil {
+		if end {
+			t = t.AddDate(0, 1, 0).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or YYYY-MM", value)
+}
+
+func parseKillTypes(value string) (uint32, uint32, error) {
+	var with, without uint32
+	if value == "" {
+		return with, without, nil
+	}
+
+	for _, t := range strings.Split(value, ",") {
+		exclude := strings.HasPrefix(t, "!")
+		t = strings.TrimPrefix(t, "!")
+
+		bit := -1
+		for i, name := range killTypeNames {
+			if name == t {
+				bit = i
+			}
+		}
+		if bit < 0 {
+			return 0, 0, fmt.Errorf("unknown kill type %q", t)
+		}
+
+		if exclude {
+			without |= 1 << bit
+		} else {
+			with |= 1 << bit
+		}
+	}
+
+	return with, without, nil
+}
+
+func (q killQuery) matchesFile(f *IndexedFile) bool {
+	if q.mapName != "" && f.Map != q.mapName {
+		return false
+	}
+	if !q.from.IsZero() && f.Date.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && f.Date.After(q.to) {
+		return false
+	}
+	return true
+}
+
+func (q killQuery) matchesKill(k IndexedKill) bool {
+	if q.player != 0 && !q.matchesRole(k.Killer == q.player, k.Victim == q.player) {
+		return false
+	}
+	if q.team != "" && !q.matchesRole(strings.EqualFold(k.KillerTeam, q.team), strings.EqualFold(k.VictimTeam, q.team)) {
+		return false
+	}
+	if q.weapon != "" && !strings.EqualFold(k.Weapon, q.weapon) {
+		return false
+	}
+	if k.KillType&q.withBits != q.withBits || k.KillType&q.withoutBits != 0 {
+		return false
+	}
+	return true
+}
+
+func (q killQuery) matchesRole(killer bool, victim bool) bool {
+	switch q.role {
+	case "killer":
+		return killer
+	case "victim":
+		return victim
+	}
+	return killer || victim
+}
+
+func killTypeString(killType uint32) string {
+	var names []string
+	for i, name := range killTypeNames {
+		if killType&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+func queryRow(cols []string, match string, f *IndexedFile, k IndexedKill) []string {
+	row := make([]string, len(cols))
+	for i, c := range cols {
+		switch c {
+		case "date":
+			row[i] = f.Date.Format(time.DateOnly)
+		case "match":
+			row[i] = match
+		case "map":
+			row[i] = f.Map
+		case "round":
+			row[i] = strconv.Itoa(k.Round)
+		case "time":
+			row[i] = fmt.Sprintf("%.1f", k.Time)
+		case "killer":
+			row[i] = k.KillerName
+		case "killer_id":
+			row[i] = strconv.FormatUint(k.Killer, 10)
+		case "killer_team":
+			row[i] = k.KillerTeam
+		case "victim":
+			row[i] = k.VictimName
+		case "victim_id":
+			row[i] = strconv.FormatUint(k.Victim, 10)
+		case "victim_team":
+			row[i] = k.VictimTeam
+		case "assister_id":
+			row[i] = strconv.FormatUint(k.Assister, 10)
+		case "weapon":
+			row[i] = k.Weapon
+		case "type":
+			row[i] = killTypeString(k.KillType)
+		case "kill_type":
+			row[i] = strconv.FormatUint(uint64(k.KillType), 10)
+		case "side":
+			row[i] = strconv.Itoa(k.Side)
+		}
+	}
+	return row
+}
+
+// Indexed files by date, without the parts of merged matches
+func (index *QueryIndex) matchFiles() []string {
+	parts := make(map[string]bool)
+	for _, f := range index.Files {
+		for _, name := range f.MergedFrom {
+			parts[name] = true
+		}
+	}
+
+	var names []string
+	for name := range index.Files {
+		if !parts[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := index.Files[names[i]], index.Files[names[j]]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+func loadQueryIndex(indexPath string) *QueryIndex {
+	index := &QueryIndex{Version: queryIndexVersion, Files: make(map[string]*IndexedFile)}
+
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn(fmt.Sprintf("Error reading query index, rebuilding it: %v", err))
+		}
+		return index
+	}
+
+	var stored QueryIndex
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Version != queryIndexVersion || stored.Files == nil {
+		slog.Warn("Query index is outdated or broken, rebuilding it")
+		return index
+	}
+
+	return &stored
+}
+
+// Brings the index up to date with the parsed directory and saves it if anything changed
+func updateQueryIndex(indexPath string, parsedDir string) (*QueryIndex, error) {
+	index := loadQueryIndex(indexPath)
+
+	files, err := os.ReadDir(parsedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	seen := make(map[string]bool)
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), "_scoreboard.json") {
+			continue
+		}
+		seen[file.Name()] = true
+
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		if indexed, ok := index.Files[file.Name()]; ok && indexed.Size == info.Size() && indexed.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		sb, err := loadScoreboardJson(filepath.Join(parsedDir, file.Name()))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Skipping %v: %v", file.Name(), err))
+			continue
+		}
+
+		index.Files[file.Name()] = indexScoreboard(ParsedScoreboard{File: file.Name(), Scoreboard: sb}, info)
+		changed = true
+	}
+
+	for name := range index.Files {
+		if !seen[name] {
+			delete(index.Files, name)
+			changed = true
+		}
+	}
+
+	if changed {
+		data, err := json.Marshal(index)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(indexPath, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+func indexScoreboard(sb ParsedScoreboard, info os.FileInfo) *IndexedFile {
+	f := &IndexedFile{
+		ModTime:    info.ModTime(),
+		Size:       info.Size(),
+		Map:        sb.MapName,
+		Date:       sb.date(),
+		MergedFrom: sb.MergedFrom,
+	}
+
+	for _, k := range sb.Kills {
+		ik := IndexedKill{KillEvent: k}
+		if killer := sb.getPlayer(k.Killer); killer != nil {
+			ik.KillerName, ik.KillerTeam = killer.Nickname, killer.Team
+		}
+		if victim := sb.getPlayer(k.Victim); victim != nil {
+			ik.VictimName, ik.VictimTeam = victim.Nickname, victim.Team
+		}
+		f.Kills = append(f.Kills, ik)
+	}
+
+	return f
+}
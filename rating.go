@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Glicko-2 parameters, see http://www.glicko.net/glicko/glicko2.pdf
+const (
+	glickoScale       = 173.7178
+	glickoTau         = 0.5
+	glickoEpsilon     = 0.000001
+	initialRating     = 1500.0
+	initialDeviation  = 350.0
+	initialVolatility = 0.06
+)
+
+type PlayerRating struct {
+	SteamID    uint64  `json:"steam_id"`
+	Nickname   string  `json:"nickname"`
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+	Matches    int     `json:"matches"`
+}
+
+type RatingHistoryEntry struct {
+	Match     string    `json:"match"`
+	Date      time.Time `json:"date"`
+	SteamID   uint64    `json:"steam_id"`
+	Rating    float64   `json:"rating"`
+	Deviation float64   `json:"deviation"`
+}
+
+type RatingStore struct {
+	Players map[uint64]*PlayerRating `json:"players"`
+	History []RatingHistoryEntry     `json:"history"`
+}
+
+func newPlayerRating(steamID uint64) *PlayerRating {
+	return &PlayerRating{SteamID: steamID, Rating: initialRating, Deviation: initialDeviation, Volatility: initialVolatility}
+}
+
+func ratingCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("rating", flag.ExitOnError)
+	out := fs.String("out", "data/ratings.json", "json file for the ratings and rating history")
+	weight := fs.Float64("performance-weight", 0, "0..1, how much the match performance (rating from ADR and KAST) counts instead of the result")
+	player := fs.Uint64("player", 0, "print rating over time for this player (SteamID64)")
+	top := fs.Int("top", 0, "print only this many players in the leaderboard")
+	fs.Parse(args)
+
+	if *weight < 0 || *weight > 1 {
+		return fmt.Errorf("performance weight must be between 0 and 1")
+	}
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	// Ratings are always recalculated from the first match so the order of parsing doesn't matter
+	sort.SliceStable(scoreboards, func(i, j int) bool {
+		return scoreboards[i].date().Before(scoreboards[j].date())
+	})
+
+	store := RatingStore{Players: make(map[uint64]*PlayerRating)}
+	for _, sb := range scoreboards {
+		store.updateMatch(sb, *weight)
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	if *player != 0 {
+		store.printSeries(*player)
+	} else {
+		store.printLeaderboard(*top)
+	}
+
+	slog.Info(fmt.Sprintf("Rated %v matches, ratings saved to %v", len(scoreboards), *out))
+
+	return nil
+}
+
+// Every player plays one game against the average of the opposing team
+func (rs *RatingStore) updateMatch(sb ParsedScoreboard, weight float64) {
+	teams := make(map[int][]PlayerScore)
+	for _, ps := range sb.PlayerScores {
+		teams[ps.TeamId] = append(teams[ps.TeamId], ps)
+	}
+
+	if len(teams) != 2 {
+		slog.Warn(fmt.Sprintf("%v has %v teams, skipping rating", sb.File, len(teams)))
+		return
+	}
+
+	for _, ps := range sb.PlayerScores {
+		if rs.Players[ps.SteamID] == nil {
+			rs.Players[ps.SteamID] = newPlayerRating(ps.SteamID)
+		}
+	}
+
+	updated := make(map[uint64]PlayerRating)
+	for teamID, team := range teams {
+		var opponents []*PlayerRating
+		for otherID, other := range teams {
+			if otherID == teamID {
+				continue
+			}
+			for _, ps := range other {
+				opponents = append(opponents, rs.Players[ps.SteamID])
+			}
+		}
+
+		opponentMu, opponentPhi := compositeOpponent(opponents)
+
+		for _, ps := range team {
+			score := (float64(matchResult(sb.Scoreboard, ps)) + 1) / 2
+			performance := min(max(0.5+(ps.Rating-1)/2, 0), 1)
+			score = (1-weight)*score + weight*performance
+
+			r := *rs.Players[ps.SteamID]
+			r.glicko2Update(opponentMu, opponentPhi, score)
+			r.Nickname = ps.Nickname
+			r.Matches += 1
+			updated[ps.SteamID] = r
+		}
+	}
+
+	// Updates are applied after every player has been calculated so teammates don't affect each other
+	for _, ps := range sb.PlayerScores {
+		id, r := ps.SteamID, updated[ps.SteamID]
+		*rs.Players[id] = r
+		rs.History = append(rs.History, RatingHistoryEntry{Match: sb.File, Date: sb.date(), SteamID: id, Rating: r.Rating, Deviation: r.Deviation})
+	}
+}
+
+func compositeOpponent(opponents []*PlayerRating) (float64, float64) {
+	mu, phiSquared := 0.0, 0.0
+	for _, o := range opponents {
+		mu += (o.Rating - initialRating) / glickoScale
+		phiSquared += math.Pow(o.Deviation/glickoScale, 2)
+	}
+	n := float64(len(opponents))
+	return mu / n, math.Sqrt(phiSquared / n)
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// One rating period with a single game against the opponent, score 0..1
+func (r *PlayerRating) glicko2Update(opponentMu float64, opponentPhi float64, score float64) {
+	mu := (r.Rating - initialRating) / glickoScale
+	phi := r.Deviation / glickoScale
+	sigma := r.Volatility
+
+	g := glickoG(opponentPhi)
+	e := 1 / (1 + math.Exp(-g*(mu-opponentMu)))
+	v := 1 / (g * g * e * (1 - e))
+	delta := v * g * (score - e)
+
+	// Volatility with the Illinois algorithm
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(glickoTau*glickoTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k += 1
+		}
+		B = a - k*glickoTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA = fA / 2
+		}
+		B, fB = C, fC
+	}
+
+	newSigma := math.Exp(A / 2)
+	phiStar := math.Sqrt(phi*phi + newSigma*newSigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*g*(score-e)
+
+	r.Rating = newMu*glickoScale + initialRating
+	r.Deviation = newPhi * glickoScale
+	r.Volatility = newSigma
+}
+
+func (rs *RatingStore) printLeaderboard(top int) {
+	var players []*PlayerRating
+	for _, p := range rs.Players {
+		players = append(players, p)
+	}
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Rating > players[j].Rating
+	})
+
+	if top > 0 && top < len(players) {
+		players = players[:top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tsteam id\tnickname\trating\tdeviation\tmatches")
+	for i, p := range players {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.0f\t%.0f\t%v\n", i+1, p.SteamID, p.Nickname, p.Rating, p.Deviation, p.Matches)
+	}
+	w.Flush()
+}
+
+func (rs *RatingStore) printSeries(steamID uint64) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "date\tmatch\trating\tdeviation")
+	for _, h := range rs.History {
+		if h.SteamID == steamID {
+			fmt.Fprintf(w, "%v\t%v\t%.0f\t%.0f\n", h.Date.Format(time.DateOnly), h.Match, h.Rating, h.Deviation)
+		}
+	}
+	w.Flush()
+}
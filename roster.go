@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Roster file maps SteamID64s to canonical names and teams. A player can have several entries with
+// different validity dates, e.g. when changing teams. Empty dates mean no limit.
+//
+//	{"players": [{"steam_id": 76561198000000000, "name": "Player", "team": "Team", "valid_from": "2024-01-01", "valid_to": "2024-06-30"}]}
+type Roster struct {
+	Players []RosterEntry `json:"players"`
+}
+
+type RosterEntry struct {
+	SteamID   uint64 `json:"steam_id"`
+	Name      string `json:"name"`
+	Team      string `json:"team"`
+	ValidFrom string `json:"valid_from"`
+	ValidTo   string `json:"valid_to"`
+
+	from time.Time
+	to   time.Time
+}
+
+// Missing roster file isn't an error, the in-game names and clan names are used then
+func loadRoster(path string) (*Roster, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r Roster
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid roster file %v: %w", path, err)
+	}
+
+	for i, e := range r.Players {
+		if r.Players[i].from, err = parseQueryDate(e.ValidFrom, false); err != nil {
+			return nil, fmt.Errorf("roster entry for %v: %w", e.SteamID, err)
+		}
+		if r.Players[i].to, err = parseQueryDate(e.ValidTo, true); err != nil {
+			return nil, fmt.Errorf("roster entry for %v: %w", e.SteamID, err)
+		}
+	}
+
+	return &r, nil
+}
+
+// Returns the roster entry valid on the date, or nil. Unknown dates match only entries without limits
+func (r *Roster) lookup(steamID uint64, date time.Time) *RosterEntry {
+	if r == nil {
+		return nil
+	}
+
+	for i, e := range r.Players {
+		if e.SteamID != steamID {
+			continue
+		}
+		if !e.from.IsZero() && (date.IsZero() || date.Before(e.from)) {
+			continue
+		}
+		if !e.to.IsZero() && (date.IsZero() || date.After(e.to)) {
+			continue
+		}
+		return &r.Players[i]
+	}
+
+	return nil
+}
+
+// Name and team from the roster override the in-game name and clan name
+func (ps *PlayerScore) applyRoster(r *Roster, date time.Time) {
+	e := r.lookup(ps.SteamID, date)
+	if e == nil {
+		return
+	}
+
+	if e.Name != "" {
+		ps.Nickname = e.Name
+		ps.RosterName = true
+	}
+	if e.Team != "" {
+		ps.Team = e.Team
+	}
+}
+
+func (ps *PlayerScore) addAlias(name string) {
+	if name != "" && !slices.Contains(ps.Aliases, name) {
+		ps.Aliases = append(ps.Aliases, name)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Written at the end of a batch run as json and as a text summary
+type RunReport struct {
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Totals   RunTotals       `json:"totals"`
+	Demos    []RunReportDemo `json:"demos"`
+}
+
+type RunTotals struct {
+	Demos    int            `json:"demos"`
+	ByStatus map[string]int `json:"by_status"`
+	Rounds   int            `json:"rounds"`
+	Warnings int            `json:"warnings"`
+	Seconds  float64        `json:"seconds"` // Time spent parsing demos
+}
+
+type RunReportDemo struct {
+	Demo     string         `json:"demo"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Seconds  float64        `json:"seconds"`
+	Rounds   int            `json:"rounds"`
+	Warnings []ParseWarning `json:"warnings"`
+	Outputs  []string       `json:"outputs"`
+}
+
+func newRunReport(results []parseResult, started time.Time) RunReport {
+	report := RunReport{
+		Started:  started,
+		Finished: time.Now(),
+		Totals:   RunTotals{ByStatus: make(map[string]int)},
+		Demos:    []RunReportDemo{},
+	}
+
+	for _, r := range results {
+		d := RunReportDemo{
+			Demo:     r.Demo,
+			Status:   r.Status,
+			Seconds:  r.Duration.Seconds(),
+			Rounds:   r.Rounds,
+			Warnings: r.Warnings,
+			Outputs:  r.Outputs,
+		}
+		if r.Err != nil {
+			d.Error = r.Err.Error()
+		}
+		report.Demos = append(report.Demos, d)
+
+		report.Totals.Demos += 1
+		report.Totals.ByStatus[r.Status] += 1
+		report.Totals.Rounds += r.Rounds
+		report.Totals.Warnings += len(r.Warnings)
+		report.Totals.Seconds += r.Duration.Seconds()
+	}
+
+	return report
+}
+
+// Writes run_<time>.json and run_<time>.txt to the report directory
+func writeRunReport(results []parseResult, started time.Time, reportDir string) error {
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		return err
+	}
+
+	report := newRunReport(results, started)
+	name := filepath.Join(reportDir, "run_"+started.Format("2006-01-02_15-04-05"))
+
+	err := writeFileAtomic(name+".json", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(name+".txt", report.writeSummary); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Run report written to %v.json and %v.txt", name, name))
+
+	return nil
+}
+
+// Skipped demos are only counted, everything else is listed with its warnings and errors
+func (report RunReport) writeSummary(out io.Writer) error {
+	fmt.Fprintf(out, "Run %v, took %v\n", report.Started.Format(time.DateTime), report.Finished.Sub(report.Started).Round(time.Second))
+
+	var statuses []string
+	for status := range report.Totals.ByStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for i, status := range statuses {
+		statuses[i] = fmt.Sprintf("%v %v", report.Totals.ByStatus[status], status)
+	}
+	fmt.Fprintf(out, "%v demos: %v. %v rounds, %v warnings\n\n", report.Totals.Demos, strings.Join(statuses, ", "), report.Totals.Rounds, report.Totals.Warnings)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "status\tdemo\trounds\ttime\twarnings\terror")
+	for _, d := range report.Demos {
+		if d.Status == StatusSkipped {
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.1fs\t%v\t%v\n", d.Status, d.Demo, d.Rounds, d.Seconds, len(d.Warnings), d.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, d := range report.Demos {
+		if len(d.Warnings) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%v\n", d.Demo)
+		for _, warning := range d.Warnings {
+			fmt.Fprintf(out, "  %v: %v\n", warning.Code, warning.Message)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Series struct {
+	ID      string         `json:"id"`
+	Teams   []string       `json:"teams"`
+	Maps    []SeriesMap    `json:"maps"`
+	MapWins map[string]int `json:"map_wins"`
+	Winner  string         `json:"winner"` // Empty when the series is tied
+	Players []*CareerStats `json:"players"`
+}
+
+type SeriesMap struct {
+	File   string         `json:"file"`
+	Map    string         `json:"map"`
+	Date   time.Time      `json:"date"`
+	Rounds map[string]int `json:"rounds"` // Rounds won by team
+	Winner string         `json:"winner"`
+}
+
+func seriesCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("series", flag.ExitOnError)
+	out := fs.String("out", "data/series/", "directory for the series json files")
+	pattern := fs.String("pattern", "", "regexp for filenames with a (?P<series>...) group, files with the same series id belong together")
+	window := fs.Duration("window", 6*time.Hour, "without -pattern, matches between the same rosters at most this far apart are one series. "+
+		"Matches without a time of day are compared by day")
+	fs.Parse(args)
+
+	var re *regexp.Regexp
+	if *pattern != "" {
+		var err error
+		if re, err = regexp.Compile(*pattern); err != nil {
+			return err
+		}
+		if re.SubexpIndex("series") < 0 {
+			return fmt.Errorf("pattern needs a (?P<series>...) group")
+		}
+	}
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(scoreboards, func(i, j int) bool {
+		return scoreboards[i].date().Before(scoreboards[j].date())
+	})
+
+	var groups map[string][]ParsedScoreboard
+	if re != nil {
+		groups = groupSeriesByPattern(scoreboards, re)
+	} else {
+		groups = groupSeriesByRoster(scoreboards, *window)
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+
+	var ids []string
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		series := buildSeries(id, groups[id])
+
+		data, err := json.MarshalIndent(series, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(*out, seriesFilename(id)), data, 0644); err != nil {
+			return err
+		}
+
+		var scores []string
+		for _, team := range series.Teams {
+			scores = append(scores, fmt.Sprintf("%v %v", team, series.MapWins[team]))
+		}
+		fmt.Printf("%v: %v (%v maps)\n", id, strings.Join(scores, " - "), len(series.Maps))
+	}
+
+	slog.Info(fmt.Sprintf("%v series written to %v", len(groups), *out))
+
+	return nil
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func seriesFilename(id string) string {
+	return unsafeFilename.ReplaceAllString(id, "_") + "_series.json"
+}
+
+func groupSeriesByPattern(scoreboards []ParsedScoreboard, re *regexp.Regexp) map[string][]ParsedScoreboard {
+	groups := make(map[string][]ParsedScoreboard)
+	for _, sb := range scoreboards {
+		m := re.FindStringSubmatch(sb.File)
+		if m == nil {
+			continue
+		}
+		id := m[re.SubexpIndex("series")]
+		groups[id] = append(groups[id], sb)
+	}
+	return groups
+}
+
+// Roster key is the same for both teams in either order, so the matches of a series share it even after side swaps
+func rosterKey(sb Scoreboard) string {
+	var keys []string
+	for _, team := range matchTeams(sb, "roster", nil) {
+		ids := slices.Clone(team.players)
+		slices.Sort(ids)
+
+		var parts []string
+		for _, id := range ids {
+			parts = append(parts, strconv.FormatUint(id, 10))
+		}
+		keys = append(keys, strings.Join(parts, ","))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+// Scoreboards must be in chronological order. Match dates have the time of day when the demo was modified on the
+// match day, otherwise only the day, and then every match of the day between the rosters is within the window
+func groupSeriesByRoster(scoreboards []ParsedScoreboard, window time.Duration) map[string][]ParsedScoreboard {
+	groups := make(map[string][]ParsedScoreboard)
+	open := make(map[string]string) // roster key -> id of the latest series between the rosters
+
+	for _, sb := range scoreboards {
+		key := rosterKey(sb.Scoreboard)
+
+		id, ok := open[key]
+		if ok {
+			previous := groups[id][len(groups[id])-1]
+			if sb.date().Sub(previous.date()) > window {
+				ok = false
+			}
+		}
+
+		if !ok {
+			id = sb.date().Format(time.DateOnly) + "_" + strings.TrimSuffix(sb.File, "_scoreboard.json")
+			open[key] = id
+		}
+
+		groups[id] = append(groups[id], sb)
+	}
+
+	// Single matches aren't series
+	for id, matches := range groups {
+		if len(matches) < 2 {
+			delete(groups, id)
+		}
+	}
+
+	return groups
+}
+
+func buildSeries(id string, matches []ParsedScoreboard) Series {
+	series := Series{ID: id, MapWins: make(map[string]int)}
+
+	// Teams are named after the first map, and recognized on later maps by their players
+	names := playerNames(matches)
+	var teamPlayers [][]uint64
+	for _, team := range matchTeams(matches[0].Scoreboard, "clan", names) {
+		series.Teams = append(series.Teams, team.name)
+		series.MapWins[team.name] = 0
+		teamPlayers = append(teamPlayers, team.players)
+	}
+
+	for _, sb := range matches {
+		m := SeriesMap{File: sb.File, Map: sb.MapName, Date: sb.date(), Rounds: make(map[string]int)}
+
+		for _, team := range matchTeams(sb.Scoreboard, "clan", names) {
+			name := team.name
+			for i, players := range teamPlayers {
+				if slices.ContainsFunc(team.players, func(id uint64) bool { return slices.Contains(players, id) }) {
+					name = series.Teams[i]
+					break
+				}
+			}
+
+			m.Rounds[name] = team.rounds
+			if team.result == 1 {
+				m.Winner = name
+				series.MapWins[name] += 1
+			}
+		}
+
+		series.Maps = append(series.Maps, m)
+	}
+
+	best := -1
+	for _, team := range series.Teams {
+		switch wins := series.MapWins[team]; {
+		case wins > best:
+			best = wins
+			series.Winner = team
+		case wins == best:
+			series.Winner = ""
+		}
+	}
+
+	series.Players = aggregateCareers(matches)
+
+	return series
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued  = "queued"
+	JobParsing = "parsing"
+)
+
+// Status is queued, parsing or one of the manifest statuses when the job is done
+type Job struct {
+	ID         string    `json:"id"`
+	Demo       string    `json:"demo"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Scoreboard string    `json:"scoreboard,omitempty"` // URL of the scoreboard when parsed
+	Created    time.Time `json:"created"`
+	Started    time.Time `json:"started,omitempty"`
+	Finished   time.Time `json:"finished,omitempty"`
+
+	input   demoInput
+	events  []ProgressEvent // Progress of the parse for /jobs/{id}/events
+	changed chan struct{}   // Closed and replaced when the job changes
+}
+
+type server struct {
+	demosDir     string
+	parsedDir    string
+	manifestFile string
+	opts         parseOptions
+	maxUpload    int64         // Bytes
+	keepJobs     time.Duration // How long finished jobs and their events are kept
+
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	nextID int
+	queue  chan *Job
+
+	manifestMu sync.Mutex // Workers parse in parallel but the manifest file is read and written by one at a time
+	workers    sync.WaitGroup
+}
+
+func serveCommand(ctx context.Context, args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	workers := fs.Int("workers", 2, "demos parsed at the same time")
+	queueSize := fs.Int("queue", 100, "max queued jobs, uploads are refused when the queue is full")
+	demosDir := fs.String("demos", "data/demos/", "directory for uploaded demos")
+	manifestFile := fs.String("manifest", "data/manifest.json", "manifest file")
+	rosterFile := fs.String("roster", "data/roster.json", "roster file")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up on a demo that takes longer than this to parse, 0 for no limit")
+	maxUpload := fs.Int64("max-upload", 2048, "largest accepted upload in MB")
+	keepJobs := fs.Duration("keep-jobs", time.Hour, "finished jobs and their events are forgotten after this long")
+	fs.Parse(args)
+
+	roster, err := loadRoster(*rosterFile)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{*demosDir, parsedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	s := &server{
+		demosDir:     *demosDir,
+		parsedDir:    parsedDir,
+		manifestFile: *manifestFile,
+		opts:         parseOptions{roster: roster, timeout: *timeout},
+		maxUpload:    *maxUpload << 20,
+		keepJobs:     *keepJobs,
+		jobs:         make(map[string]*Job),
+		queue:        make(chan *Job, *queueSize),
+	}
+
+	for i := 0; i < max(*workers, 1); i++ {
+		s.workers.Add(1)
+		go s.worker(ctx)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /demos", s.handleUpload)
+	mux.HandleFunc("GET /jobs", s.handleJobs)
+	mux.HandleFunc("GET /jobs/{id}", s.handleJob)
+	mux.HandleFunc("GET /jobs/{id}/events", s.handleJobEvents)
+	mux.HandleFunc("GET /matches", s.handleMatches)
+	mux.HandleFunc("GET /matches/{demo}/scoreboard", s.handleScoreboard)
+	mux.HandleFunc("GET /players", s.handlePlayers)
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+
+	// On interrupt new requests are refused and running parses are cancelled. Queued uploads stay in the demos
+	// directory and are parsed by the next run
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info(fmt.Sprintf("Serving on http://%v with %v workers", *addr, *workers))
+
+	err = srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	s.workers.Wait()
+
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func isDemoFilename(name string) bool {
+	if strings.HasSuffix(name, ".dem") || strings.HasSuffix(name, ".zip") {
+		return true
+	}
+	for _, ext := range compressedExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func uploadErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Demo is sent as a multipart form file "demo", or as the raw body with the filename in ?name=
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader
+	var name string
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("demo")
+		if err != nil {
+			writeError(w, uploadErrorStatus(err), err)
+			return
+		}
+		defer file.Close()
+		body, name = file, header.Filename
+	} else {
+		body, name = r.Body, r.URL.Query().Get("name")
+	}
+
+	name = filepath.Base(name)
+	if !isDemoFilename(name) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%q isn't a demo, use .dem, .dem.gz, .dem.bz2, .dem.zst or .zip", name))
+		return
+	}
+
+	path := filepath.Join(s.demosDir, name)
+
+	// Written under a temporary name so a half uploaded demo is never parsed
+	tmp, err := os.CreateTemp(s.demosDir, ".upload-*")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeError(w, uploadErrorStatus(err), err)
+		return
+	}
+	// Linking fails when the name is taken, so two uploads with the same name can't overwrite each other
+	if err := os.Link(tmp.Name(), path); errors.Is(err, os.ErrExist) {
+		writeError(w, http.StatusConflict, fmt.Errorf("%v already exists", name))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	input, err := fileDemoInput(path)
+	if err != nil {
+		os.Remove(path)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.nextID += 1
+	job := &Job{ID: strconv.Itoa(s.nextID), Demo: input.Name, Status: JobQueued, Created: time.Now(), input: input, changed: make(chan struct{})}
+	s.jobs[job.ID] = job
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- job:
+	default:
+		s.mu.Lock()
+		delete(s.jobs, job.ID)
+		s.mu.Unlock()
+		os.Remove(path)
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("job queue is full"))
+		return
+	}
+
+	slog.Info(fmt.Sprintf("Job %v queued for %v", job.ID, job.Demo))
+
+	writeJSON(w, http.StatusAccepted, s.jobCopy(job))
+}
+
+// Copy made under the lock so a worker updating the job doesn't race with encoding it
+func (s *server) jobCopy(job *Job) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *job
+}
+
+func (s *server) updateJob(job *Job, update func(j *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(job)
+
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+func (s *server) worker(ctx context.Context) {
+	defer s.workers.Done()
+
+	for {
+		var job *Job
+		select {
+		case job = <-s.queue:
+		case <-ctx.Done():
+			return
+		}
+
+		s.updateJob(job, func(j *Job) {
+			j.Status = JobParsing
+			j.Started = time.Now()
+		})
+
+		status, err := s.parseJob(ctx, job)
+		s.finishJob(job, status, err)
+	}
+}
+
+// Finished jobs stay for keepJobs so clients can still get the result, then they are forgotten
+func (s *server) finishJob(job *Job, status string, err error) {
+	s.updateJob(job, func(j *Job) {
+		j.Status = status
+		j.Finished = time.Now()
+		if err != nil {
+			j.Error = err.Error()
+		}
+		if status == StatusParsed {
+			j.Scoreboard = "/matches/" + j.Demo + "/scoreboard"
+		}
+	})
+
+	slog.Info(fmt.Sprintf("Job %v for %v finished: %v", job.ID, job.Demo, status))
+
+	time.AfterFunc(s.keepJobs, func() {
+		s.mu.Lock()
+		delete(s.jobs, job.ID)
+		s.mu.Unlock()
+	})
+}
+
+// Same steps as parseDemos for one demo, with the manifest locked only while it's used
+func (s *server) parseJob(ctx context.Context, job *Job) (string, error) {
+	hash, err := job.input.hash()
+	if err != nil {
+		return StatusFailed, err
+	}
+
+	s.manifestMu.Lock()
+	manifest, err := loadManifest(s.manifestFile)
+	if err == nil {
+		if original := manifest.byHash(job.Demo, hash); original != "" {
+			manifest.Demos[job.Demo] = &ManifestEntry{Hash: hash, Status: StatusDuplicate, DuplicateOf: original}
+			err = manifest.save(s.manifestFile)
+			s.manifestMu.Unlock()
+			return StatusDuplicate, err
+		}
+	}
+	s.manifestMu.Unlock()
+	if err != nil {
+		return StatusFailed, err
+	}
+
+	opts := s.opts
+	opts.progress = func(ev ProgressEvent) {
+		s.updateJob(job, func(j *Job) { j.events = append(j.events, ev) })
+	}
+	_, parseErr := parseSingleDemo(ctx, job.input, s.parsedDir, opts)
+	if parseErr != nil && ctx.Err() != nil {
+		return StatusCancelled, parseErr
+	}
+
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	manifest, err = loadManifest(s.manifestFile)
+	if err != nil {
+		return StatusFailed, err
+	}
+
+	status := StatusFailed
+	if parseErr != nil {
+		manifest.recordFailed(job.Demo, hash, parseErr)
+	} else if err = manifest.recordParsed(job.Demo, hash, s.parsedDir, parserVersion, s.opts.collectors()); err == nil {
+		status = manifest.Demos[job.Demo].Status
+	}
+
+	if saveErr := manifest.save(s.manifestFile); err == nil {
+		err = saveErr
+	}
+	if parseErr != nil {
+		err = parseErr
+	}
+
+	return status, err
+}
+
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	job, ok := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %v", r.PathValue("id")))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.jobCopy(job))
+}
+
+func jobDone(job *Job) bool {
+	return job.Status != JobQueued && job.Status != JobParsing
+}
+
+// Server-sent events of the parse progress and the running scoreboard after every round. Events sent before
+// connecting are replayed first, and the stream ends with a done event holding the finished job
+func (s *server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	job, ok := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %v", r.PathValue("id")))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sent := 0
+	for {
+		s.mu.Lock()
+		events := job.events[sent:]
+		done := jobDone(job)
+		final := *job
+		changed := job.changed
+		s.mu.Unlock()
+
+		for _, ev := range events {
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Type, data)
+		}
+		sent += len(events)
+
+		if done {
+			data, _ := json.Marshal(final)
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type MatchSummary struct {
+	Demo     string         `json:"demo"`
+	Map      string         `json:"map"`
+	Date     time.Time      `json:"date"`
+	Rounds   int            `json:"rounds"`
+	Score    map[string]int `json:"score"` // Rounds won by team
+	Winner   string         `json:"winner"`
+	Players  int            `json:"players"`
+	Warnings []string       `json:"warnings"` // Codes of the scoreboard's warnings
+}
+
+func (s *server) handleMatches(w http.ResponseWriter, r *http.Request) {
+	scoreboards, err := loadParsedScoreboards(s.parsedDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sort.SliceStable(scoreboards, func(i, j int) bool { return scoreboards[i].date().After(scoreboards[j].date()) })
+
+	names := playerNames(scoreboards)
+	matches := make([]MatchSummary, 0, len(scoreboards))
+	for _, sb := range scoreboards {
+		m := MatchSummary{
+			Demo:     strings.TrimSuffix(sb.File, "_scoreboard.json"),
+			Map:      sb.MapName,
+			Date:     sb.date(),
+			Rounds:   sb.RoundsPlayed,
+			Score:    make(map[string]int),
+			Players:  len(sb.PlayerScores),
+			Warnings: []string{},
+		}
+		for _, w := range sb.Warnings {
+			m.Warnings = append(m.Warnings, w.Code)
+		}
+		for _, team := range matchTeams(sb.Scoreboard, "clan", names) {
+			m.Score[team.name] = team.rounds
+			if team.result == 1 {
+				m.Winner = team.name
+			}
+		}
+		matches = append(matches, m)
+	}
+
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// ?format=csv gives one row per player with the number and text fields
+func (s *server) handleScoreboard(w http.ResponseWriter, r *http.Request) {
+	demo := filepath.Base(r.PathValue("demo"))
+	sb, err := loadScoreboardJson(filepath.Join(s.parsedDir, demo+"_scoreboard.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%v hasn't been parsed", demo))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, sb)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", demo+"_scoreboard.csv"))
+		writeScoreboardCSV(w, sb)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, use json or csv", r.URL.Query().Get("format")))
+	}
+}
+
+func writeScoreboardCSV(w io.Writer, sb Scoreboard) error {
+	t := reflect.TypeOf(PlayerScore{})
+
+	var header []string
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Uint64, reflect.Float64, reflect.String:
+			if f.IsExported() {
+				header = append(header, counterName(f))
+				fields = append(fields, i)
+			}
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, ps := range sb.PlayerScores {
+		v := reflect.ValueOf(ps)
+		row := make([]string, len(fields))
+		for i, field := range fields {
+			row[i] = fmt.Sprint(v.Field(field).Interface())
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// Career stats over the parsed matches, filtered like the aggregate command with ?map=, ?player= and ?files=
+func (s *server) handlePlayers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := scoreboardFilter{mapName: q.Get("map"), files: q.Get("files")}
+	if player := q.Get("player"); player != "" {
+		id, err := strconv.ParseUint(player, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid player %q", player))
+			return
+		}
+		filter.player = id
+	}
+
+	scoreboards, err := loadParsedScoreboards(s.parsedDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var selected []ParsedScoreboard
+	for _, sb := range scoreboards {
+		if filter.matches(sb) {
+			selected = append(selected, sb)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, aggregateCareers(selected))
+}
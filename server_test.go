@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinishedJobsForgotten(t *testing.T) {
+	job := &Job{ID: "1", Demo: "test.dem", Status: JobParsing, changed: make(chan struct{})}
+	s := &server{jobs: map[string]*Job{job.ID: job}, keepJobs: 50 * time.Millisecond}
+
+	s.finishJob(job, StatusParsed, nil)
+
+	s.mu.Lock()
+	_, kept := s.jobs[job.ID]
+	s.mu.Unlock()
+	if !kept {
+		t.Fatal("job was forgotten right after finishing")
+	}
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		_, kept = s.jobs[job.ID]
+		s.mu.Unlock()
+		if !kept {
+			return
+		}
+	}
+	t.Errorf("job was kept after %v", s.keepJobs)
+}
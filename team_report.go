@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type TeamMapStats struct {
+	Team          string  `json:"team"`
+	Map           string  `json:"map"`
+	GamesPlayed   int     `json:"games_played"`
+	Wins          int     `json:"wins"`
+	Losses        int     `json:"losses"`
+	Draws         int     `json:"draws"`
+	WinRate       float64 `json:"win_rate"`
+	RoundsWon     int     `json:"rounds_won"`
+	RoundsLost    int     `json:"rounds_lost"`
+	RoundDiff     int     `json:"round_differential"`
+	CTRoundsWon   int     `json:"ct_rounds_won"`
+	CTRounds      int     `json:"ct_rounds"`
+	CTWinRate     float64 `json:"ct_win_rate"`
+	TRoundsWon    int     `json:"t_rounds_won"`
+	TRounds       int     `json:"t_rounds"`
+	TWinRate      float64 `json:"t_win_rate"`
+	PistolsWon    int     `json:"pistols_won"`
+	PistolsPlayed int     `json:"pistols_played"`
+	PistolWinRate float64 `json:"pistol_win_rate"`
+}
+
+// Team in one match
+type matchTeam struct {
+	name    string
+	players []uint64
+	result  int
+	rounds  int
+}
+
+func teamReportCommand(args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("teams", flag.ExitOnError)
+	out := fs.String("out", "data/team_report.json", "json file for the report")
+	groupBy := fs.String("group", "clan", "identify teams by clan name (falls back to roster when blank) or roster")
+	mapName := fs.String("map", "", "only matches on this map")
+	fs.Parse(args)
+
+	if *groupBy != "clan" && *groupBy != "roster" {
+		return fmt.Errorf("unknown grouping %q, use clan or roster", *groupBy)
+	}
+
+	scoreboards, err := loadParsedScoreboards(parsedDir)
+	if err != nil {
+		return err
+	}
+
+	names := playerNames(scoreboards)
+	stats := make(map[string]*TeamMapStats)
+	for _, sb := range scoreboards {
+		if *mapName != "" && sb.MapName != *mapName {
+			continue
+		}
+
+		for _, team := range matchTeams(sb.Scoreboard, *groupBy, names) {
+			for _, m := range []string{sb.MapName, "all"} {
+				key := team.name + "\x00" + m
+				if stats[key] == nil {
+					stats[key] = &TeamMapStats{Team: team.name, Map: m}
+				}
+				stats[key].addMatch(sb.Scoreboard, team)
+			}
+		}
+	}
+
+	var report []*TeamMapStats
+	for _, s := range stats {
+		s.calculateRates()
+		report = append(report, s)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Team != report[j].Team {
+			return report[i].Team < report[j].Team
+		}
+		return report[i].Map < report[j].Map
+	})
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "team\tmap\tgames\twin rate\trounds +/-\tct win rate\tt win rate\tpistol win rate")
+	for _, s := range report {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.0f%%\t%+d\t%.0f%%\t%.0f%%\t%.0f%%\n", s.Team, s.Map, s.GamesPlayed, s.WinRate*100, s.RoundDiff, s.CTWinRate*100, s.TWinRate*100, s.PistolWinRate*100)
+	}
+	w.Flush()
+
+	slog.Info(fmt.Sprintf("Team report saved to %v", *out))
+
+	return nil
+}
+
+// Names are from playerNames, nil to name rosters with the names in the scoreboard
+func matchTeams(sb Scoreboard, groupBy string, names map[uint64]string) []matchTeam {
+	byID := make(map[int]*matchTeam)
+	var ids []int
+
+	for _, ps := range sb.PlayerScores {
+		t, ok := byID[ps.TeamId]
+		if !ok {
+			t = &matchTeam{result: matchResult(sb, ps), rounds: ps.TeamRounds}
+			byID[ps.TeamId] = t
+			ids = append(ids, ps.TeamId)
+		}
+
+		t.players = append(t.players, ps.SteamID)
+		if groupBy == "clan" && t.name == "" {
+			t.name = ps.Team
+		}
+	}
+
+	var teams []matchTeam
+	for _, id := range ids {
+		t := byID[id]
+		if t.name == "" {
+			t.name = rosterName(sb, t.players, names)
+		}
+		teams = append(teams, *t)
+	}
+
+	return teams
+}
+
+// Roster is named after the players ordered by steam id. With the same name for a player in every match the same
+// five players get the same team name, even if one of them changes their in-game name
+func rosterName(sb Scoreboard, players []uint64, names map[uint64]string) string {
+	sorted := slices.Clone(players)
+	slices.Sort(sorted)
+
+	var parts []string
+	for _, id := range sorted {
+		name, ok := names[id]
+		if !ok {
+			name = sb.getPlayer(id).firstName()
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Roster file name, or the first in-game name of the match
+func (ps *PlayerScore) firstName() string {
+	if ps.RosterName || len(ps.Aliases) == 0 {
+		return ps.Nickname
+	}
+	return ps.Aliases[0]
+}
+
+// One name for every player over the scoreboards: the roster file name when a match has one, otherwise the first
+// in-game name in the earliest match
+func playerNames(scoreboards []ParsedScoreboard) map[uint64]string {
+	sorted := slices.Clone(scoreboards)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].date().Before(sorted[j].date()) })
+
+	names := make(map[uint64]string)
+	fromRoster := make(map[uint64]bool)
+	for _, sb := range sorted {
+		for _, ps := range sb.PlayerScores {
+			if _, ok := names[ps.SteamID]; !ok || (ps.RosterName && !fromRoster[ps.SteamID]) {
+				names[ps.SteamID] = ps.firstName()
+				fromRoster[ps.SteamID] = ps.RosterName
+			}
+		}
+	}
+	return names
+}
+
+func isPistolRound(round int, maxRounds int) bool {
+	return round == 1 || (maxRounds > 0 && round == maxRounds/2+1)
+}
+
+func (s *TeamMapStats) addMatch(sb Scoreboard, team matchTeam) {
+	s.GamesPlayed += 1
+	switch team.result {
+	case 1:
+		s.Wins += 1
+	case -1:
+		s.Losses += 1
+	default:
+		s.Draws += 1
+	}
+
+	s.RoundsWon += team.rounds
+	s.RoundsLost += sb.RoundsPlayed - team.rounds
+	s.RoundDiff = s.RoundsWon - s.RoundsLost
+
+	// Side stats need the round results, which older scoreboards don't have
+	for _, rr := range sb.Rounds {
+		side := 0
+		for _, id := range team.players {
+			if slices.Contains(rr.CTPlayers, id) {
+				side = 3
+				break
+			}
+			if slices.Contains(rr.TPlayers, id) {
+				side = 2
+				break
+			}
+		}
+
+		won := rr.Winner == side
+		switch side {
+		case 3:
+			s.CTRounds += 1
+			s.CTRoundsWon += boolToInt(won)
+		case 2:
+			s.TRounds += 1
+			s.TRoundsWon += boolToInt(won)
+		default:
+			continue
+		}
+
+		if isPistolRound(rr.Round, sb.MaxRounds) {
+			s.PistolsPlayed += 1
+			s.PistolsWon += boolToInt(won)
+		}
+	}
+}
+
+func rate(won int, played int) float64 {
+	if played == 0 {
+		return 0
+	}
+	return float64(won) / float64(played)
+}
+
+func (s *TeamMapStats) calculateRates() {
+	s.WinRate = rate(s.Wins, s.GamesPlayed)
+	s.CTWinRate = rate(s.CTRoundsWon, s.CTRounds)
+	s.TWinRate = rate(s.TRoundsWon, s.TRounds)
+	s.PistolWinRate = rate(s.PistolsWon, s.PistolsPlayed)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlayerNames(t *testing.T) {
+	// Roster names player 2 only from the second match on
+	roster := &Roster{Players: []RosterEntry{{SteamID: 2, Name: "second", from: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)}}}
+	match := func(day int, players ...PlayerScore) ParsedScoreboard {
+		date := time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC)
+		for i := range players {
+			players[i].applyRoster(roster, date)
+		}
+		return ParsedScoreboard{Scoreboard: Scoreboard{MatchDate: date, PlayerScores: players}}
+	}
+
+	names := playerNames([]ParsedScoreboard{
+		// The roster name of player 2 is also one of their in-game names, but not the first one
+		match(2,
+			PlayerScore{SteamID: 1, Nickname: "renamed", Aliases: []string{"renamed"}},
+			PlayerScore{SteamID: 2, Nickname: "zzz", Aliases: []string{"zzz", "second"}},
+		),
+		match(1,
+			PlayerScore{SteamID: 1, Nickname: "one", Aliases: []string{"one", "renamed"}},
+			PlayerScore{SteamID: 2, Nickname: "two", Aliases: []string{"two"}},
+		),
+	})
+
+	want := map[uint64]string{1: "one", 2: "second"}
+	for id, name := range want {
+		if names[id] != name {
+			t.Errorf("player %v is named %q, want %q", id, names[id], name)
+		}
+	}
+}
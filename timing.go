@@ -0,0 +1,158 @@
+package main
+
+import (
+	"time"
+
+	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
+)
+
+const maxReactionTime = 2 * time.Second // Longer gaps between spotting and shooting aren't reactions anymore
+
+// Times are in seconds. Reaction time is a median, the others are averages
+type TimingStats struct {
+	TimeToFirstDamage float64 `json:"time_to_first_damage"`
+	TimeToFirstKill   float64 `json:"time_to_first_kill"`
+	TimeToKill        float64 `json:"time_to_kill"`
+	ReactionTime      float64 `json:"reaction_time"` // Merged and career values are sample-weighted means of the medians, so only close to the median
+
+	FirstDamageSamples  int `json:"first_damage_samples"`
+	FirstKillSamples    int `json:"first_kill_samples"`
+	TimeToKillSamples   int `json:"time_to_kill_samples"`
+	ReactionTimeSamples int `json:"reaction_time_samples"`
+
+	firstDamageTimes []float64
+	firstKillTimes   []float64
+	timesToKill      []float64
+	reactionTimes    []float64
+}
+
+// Key for things happening between two players, e.g. attacker and victim or observer and spotted enemy
+type playerPair struct {
+	From uint64
+	To   uint64
+}
+
+var weaponClassNames = map[common.EquipmentClass]string{
+	common.EqClassUnknown:   "unknown",
+	common.EqClassPistols:   "pistol",
+	common.EqClassSMG:       "smg",
+	common.EqClassHeavy:     "heavy",
+	common.EqClassRifle:     "rifle",
+	common.EqClassEquipment: "equipment",
+	common.EqClassGrenade:   "grenade",
+}
+
+func weaponClassName(w *common.Equipment) string {
+	if w == nil {
+		return weaponClassNames[common.EqClassUnknown]
+	}
+	return weaponClassNames[w.Class()]
+}
+
+func (ps *PlayerScore) timingsFor(w *common.Equipment) []*TimingStats {
+	class := weaponClassName(w)
+	if ps.TimingsByWeaponClass[class] == nil {
+		ps.TimingsByWeaponClass[class] = &TimingStats{}
+	}
+
+	return []*TimingStats{&ps.Timings, ps.TimingsByWeaponClass[class]}
+}
+
+func (ps *PlayerScore) updateDamageTiming(attacker *common.Player, victim *common.Player, w *common.Equipment, rs RoundStats, now time.Duration) {
+	if attacker == nil || victim == nil || !rs.FreezetimeEnded || rs.RoundEnded {
+		return
+	}
+
+	if !rs.FirstDamageDone[attacker.SteamID64] {
+		rs.FirstDamageDone[attacker.SteamID64] = true
+		for _, t := range ps.timingsFor(w) {
+			t.firstDamageTimes = append(t.firstDamageTimes, (now - rs.FreezetimeEndTime).Seconds())
+		}
+	}
+
+	hit := playerPair{From: attacker.SteamID64, To: victim.SteamID64}
+	if _, ok := rs.FirstHits[hit]; !ok {
+		rs.FirstHits[hit] = now
+	}
+}
+
+func (ps *PlayerScore) updateKillTiming(killer *common.Player, victim *common.Player, w *common.Equipment, rs RoundStats, now time.Duration) {
+	if killer == nil || victim == nil || !rs.FreezetimeEnded || rs.RoundEnded {
+		return
+	}
+
+	timings := ps.timingsFor(w)
+
+	if !rs.FirstKillDone[killer.SteamID64] {
+		rs.FirstKillDone[killer.SteamID64] = true
+		for _, t := range timings {
+			t.firstKillTimes = append(t.firstKillTimes, (now - rs.FreezetimeEndTime).Seconds())
+		}
+	}
+
+	if firstHit, ok := rs.FirstHits[playerPair{From: killer.SteamID64, To: victim.SteamID64}]; ok {
+		for _, t := range timings {
+			t.timesToKill = append(t.timesToKill, (now - firstHit).Seconds())
+		}
+	}
+}
+
+// Spotting is tracked from the observer's point of view: when did the observer first see the enemy
+func updateSpotted(spotted *common.Player, rs RoundStats, now time.Duration) {
+	if spotted == nil || spotted.TeamState == nil || spotted.TeamState.Opponent == nil || !rs.FreezetimeEnded || rs.RoundEnded {
+		return
+	}
+
+	for _, observer := range spotted.TeamState.Opponent.Members() {
+		key := playerPair{From: observer.SteamID64, To: spotted.SteamID64}
+
+		if spotted.IsAlive() && observer.IsAlive() && spotted.IsSpottedBy(observer) {
+			if _, ok := rs.Spotted[key]; !ok {
+				rs.Spotted[key] = now
+			}
+		} else {
+			delete(rs.Spotted, key)
+		}
+	}
+}
+
+// The first shot after seeing enemies is the reaction to the enemy that was seen first
+func (ps *PlayerScore) updateReactionTime(shooter *common.Player, w *common.Equipment, rs RoundStats, now time.Duration) {
+	if shooter == nil || w == nil || w.Class() == common.EqClassGrenade || w.Class() == common.EqClassEquipment {
+		return
+	}
+
+	earliest := time.Duration(-1)
+	for key, seen := range rs.Spotted {
+		if key.From != shooter.SteamID64 {
+			continue
+		}
+
+		if earliest < 0 || seen < earliest {
+			earliest = seen
+		}
+		delete(rs.Spotted, key)
+	}
+
+	if earliest < 0 || now-earliest > maxReactionTime {
+		return
+	}
+
+	for _, t := range ps.timingsFor(w) {
+		t.reactionTimes = append(t.reactionTimes, (now - earliest).Seconds())
+	}
+}
+
+func (t *TimingStats) calculate() {
+	t.TimeToFirstDamage, t.FirstDamageSamples = average(t.firstDamageTimes), len(t.firstDamageTimes)
+	t.TimeToFirstKill, t.FirstKillSamples = average(t.firstKillTimes), len(t.firstKillTimes)
+	t.TimeToKill, t.TimeToKillSamples = average(t.timesToKill), len(t.timesToKill)
+	t.ReactionTime, t.ReactionTimeSamples = median(t.reactionTimes), len(t.reactionTimes)
+}
+
+func (ps *PlayerScore) calculateTimings() {
+	ps.Timings.calculate()
+	for _, t := range ps.TimingsByWeaponClass {
+		t.calculate()
+	}
+}
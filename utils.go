@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"time"
 
 	common "github.com/markus-wa/demoinfocs-golang/v4/pkg/demoinfocs/common"
@@ -54,3 +58,73 @@ func getPlayerTeam(p *common.Player) int {
 
 	return int(p.Team)
 }
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+var filenameDate = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+// Demo filenames usually have the date of the match but not the time. A demo is written until the match ends, so
+// a modification time on the same day gives the time of day. Without a date in the filename the modification time
+// is the best guess
+func matchDate(filename string, modTime time.Time) time.Time {
+	day := filenameDate.FindString(filename)
+	// Same zone as the modification time, so both kinds of dates compare and sort together
+	date, err := time.ParseInLocation(time.DateOnly, day, modTime.Location())
+	if err != nil {
+		return modTime
+	}
+
+	if modTime.Format(time.DateOnly) == day {
+		return modTime
+	}
+	return date
+}
+
+// Writes to a temporary file next to the target and renames it over the target, so an interrupted write never
+// leaves a half written file
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
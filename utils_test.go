@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchDate(t *testing.T) {
+	zone := time.FixedZone("EET", 2*60*60)
+	modTime := time.Date(2026, 3, 14, 20, 30, 0, 0, zone)
+
+	tests := []struct {
+		name     string
+		filename string
+		want     time.Time
+	}{
+		{"modified on the day", "match_2026-03-14_de_test.dem", modTime},
+		{"modified later", "match_2026-03-13_de_test.dem", time.Date(2026, 3, 13, 0, 0, 0, 0, zone)},
+		{"no date", "match.dem", modTime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchDate(tt.filename, modTime)
+			if !got.Equal(tt.want) || got.Location() != tt.want.Location() {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
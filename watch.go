@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Size and modification time of a file when it was last seen, and since when they have stayed the same
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+func watchCommand(ctx context.Context, args []string, parsedDir string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	demosDir := fs.String("demos", "data/demos/", "directory to watch for demos")
+	manifestFile := fs.String("manifest", "data/manifest.json", "manifest file")
+	rosterFile := fs.String("roster", "data/roster.json", "roster file")
+	interval := fs.Duration("interval", 5*time.Second, "how often the directory is checked")
+	settle := fs.Duration("settle", 10*time.Second, "a file is parsed when it hasn't grown for this long")
+	logFile := fs.String("log", "data/watch.log", "status log of parsed demos")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up on a demo that takes longer than this to parse, 0 for no limit")
+	quarantineAfter := fs.Int("quarantine-after", 3, "move demos that failed this many times in a row to data/quarantine/, 0 to never")
+	cacheEvents := fs.Bool("cache-events", false, "write the events of parsed demos to data/events/ for recompute")
+	fs.Parse(args)
+
+	roster, err := loadRoster(*rosterFile)
+	if err != nil {
+		return err
+	}
+
+	opts := parseOptions{roster: roster, timeout: *timeout, quarantineDir: "data/quarantine/", quarantineAfter: *quarantineAfter}
+	if *cacheEvents {
+		opts.eventsDir = "data/events/"
+	}
+
+	statusLog, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer statusLog.Close()
+
+	slog.Info(fmt.Sprintf("Watching %v for new demos", *demosDir))
+
+	files := make(map[string]watchedFile)
+	tried := make(map[string]watchedFile) // Demos are tried once per version of the file, failed ones aren't retried until they change
+
+	for {
+		ready := settledDemos(*demosDir, files, tried, *settle)
+
+		if len(ready) > 0 {
+			for _, r := range parseDemos(ctx, ready, parsedDir, *manifestFile, opts) {
+				if r.Status == StatusSkipped {
+					continue
+				}
+
+				line := fmt.Sprintf("%v\t%v\t%v\t%.1fs", time.Now().Format(time.RFC3339), r.Demo, r.Status, r.Duration.Seconds())
+				if r.Err != nil {
+					line += "\t" + r.Err.Error()
+				}
+				fmt.Fprintln(statusLog, line)
+			}
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+			slog.Info("Stopped watching")
+			return nil
+		}
+	}
+}
+
+// Demos whose files haven't changed for the settle time and haven't been tried in their current state
+func settledDemos(demosDir string, files map[string]watchedFile, tried map[string]watchedFile, settle time.Duration) []demoInput {
+	inputs, err := listDemoInputs(demosDir)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error reading demos directory: %v", err))
+		return nil
+	}
+
+	now := time.Now()
+	var ready []demoInput
+
+	for _, in := range inputs {
+		info, err := os.Stat(in.Path)
+		if err != nil {
+			continue
+		}
+
+		previous, ok := files[in.Path]
+		if !ok || previous.size != info.Size() || !previous.modTime.Equal(info.ModTime()) {
+			files[in.Path] = watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(previous.since) < settle {
+			continue
+		}
+
+		if t, ok := tried[in.String()]; ok && t.size == previous.size && t.modTime.Equal(previous.modTime) {
+			continue
+		}
+		tried[in.String()] = previous
+
+		ready = append(ready, in)
+	}
+
+	return ready
+}